@@ -4,22 +4,34 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/config"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/database"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/distribution"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/handler"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/jwt"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/policy"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/pool"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/reaper"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/registry"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/replay"
 )
 
+// shutdownGrace is how long cancelled requests may take to return on shutdown
+const shutdownGrace = 2 * time.Second
+
 func main() {
 	// Parse command-line flags
 	configPath := flag.String("config", "config.yaml", "path to configuration file")
@@ -38,13 +50,17 @@ func main() {
 
 	logger.Info(fmt.Sprintf("Configuration loaded successfully from %s", *configPath))
 
+	// Background work, including startup, is cancelled when the server shuts down
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+	defer bgCancel()
+
 	// Initialize database if enabled
 	var db *database.DB
 	var apiHandler *handler.APIHandler
 	if cfg.Database.Enabled {
 		logger.Info("Database enabled, connecting...")
 		var err error
-		db, err = database.NewDB(cfg.Database.ConnectionString)
+		db, err = database.NewDB(bgCtx, cfg.Database.ConnectionString, cfg.Database.QueryTimeout)
 		if err != nil {
 			logger.Error("Failed to connect to database", err)
 			os.Exit(1)
@@ -53,16 +69,25 @@ func main() {
 
 		logger.Info("Database connected successfully")
 
-		// Run migrations
-		migrationSQL, err := os.ReadFile("migrations/001_initial_schema.sql")
+		// Run migrations in lexical order; every migration must be idempotent
+		migrationFiles, err := filepath.Glob("migrations/*.sql")
 		if err != nil {
-			logger.Error("Failed to read migration file", err)
+			logger.Error("Failed to list migration files", err)
 			os.Exit(1)
 		}
+		sort.Strings(migrationFiles)
 
-		if err := db.RunMigrations(string(migrationSQL)); err != nil {
-			logger.Error("Failed to run migrations", err)
-			os.Exit(1)
+		for _, migrationFile := range migrationFiles {
+			migrationSQL, err := os.ReadFile(migrationFile)
+			if err != nil {
+				logger.Error("Failed to read migration file", err)
+				os.Exit(1)
+			}
+
+			if err := db.RunMigrations(bgCtx, string(migrationSQL)); err != nil {
+				logger.Error(fmt.Sprintf("Failed to run migration %s", migrationFile), err)
+				os.Exit(1)
+			}
 		}
 
 		logger.Info("Database migrations completed")
@@ -70,51 +95,208 @@ func main() {
 		// Update logger to use database storage
 		accessLogStore := database.NewAccessLogStoreAdapter(db)
 		logger = logging.NewLoggerWithStore(accessLogStore)
-
-		// Initialize API handler for UI
-		apiHandler = handler.NewAPIHandler(db, logger)
 	}
 
-	// Construct JWKS URL if not provided
-	jwksURL := cfg.GitLab.JWKSUrl
-	if jwksURL == "" {
-		jwksURL = fmt.Sprintf("%s/oauth/discovery/keys", cfg.GitLab.InstanceURL)
+	// Build identity sources; without identity_sources the gitlab section is the only source
+	var sources []jwt.Source
+	if len(cfg.IdentitySources) > 0 {
+		for _, src := range cfg.IdentitySources {
+			sources = append(sources, jwt.Source{
+				Name:            src.Name,
+				Provider:        src.Provider,
+				PolicyNamespace: src.PolicyNamespace,
+				Audience:        src.Audience,
+				Issuers:         []string{src.Issuer},
+				JWKSUrl:         src.JWKSUrl,
+				JWKSFile:        src.JWKSFile,
+				CAFile:          src.CAFile,
+				Algorithms:      src.SigningAlgorithms,
+			})
+		}
+	} else {
+		issuers := cfg.GitLab.Issuers
+		if len(issuers) == 0 {
+			issuers = []string{cfg.GitLab.InstanceURL}
+		}
+		sources = append(sources, jwt.Source{
+			Name:     "gitlab",
+			Provider: identity.ProviderGitLab,
+			Audience: cfg.GitLab.Audience,
+			Issuers:  issuers,
+			JWKSUrl:  cfg.GitLab.JWKSUrl,
+		})
 	}
 
-	// Set default issuers if not provided
-	issuers := cfg.GitLab.Issuers
-	if len(issuers) == 0 {
-		issuers = []string{cfg.GitLab.InstanceURL}
+	// Initialize JWT validator; JWKS URLs and signing algorithms come from each
+	// issuer's OIDC discovery document unless jwks_url or jwks_file overrides them
+	jwtValidator, err := jwt.NewValidator(sources, jwt.RefreshOptions{
+		Interval:    cfg.GitLab.JWKSRefreshInterval,
+		MinInterval: cfg.GitLab.JWKSMinRefreshInterval,
+		MaxStale:    cfg.GitLab.JWKSMaxStale,
+	})
+	if err != nil {
+		logger.Error("Failed to initialize JWT validator", err)
+		os.Exit(1)
 	}
+	logger.Info(fmt.Sprintf("JWT validator initialized with %d identity source(s)", len(sources)))
 
-	// Initialize JWT validator
-	jwtValidator := jwt.NewValidator(cfg.GitLab.Audience, issuers, jwksURL)
-	logger.Info("JWT validator initialized")
+	// Normalize verified tokens into workload identities with each source's provider
+	authenticator := identity.NewAuthenticator(jwtValidator)
 
-	// Initialize policy engine
+	// Initialize policy engine and permission profiles
 	var policyEngine *policy.Engine
+	var profiles *policy.Profiles
 	if cfg.Database.Enabled {
 		// Use database-backed policy store
 		policyStore := database.NewPolicyStoreAdapter(db)
-		policyEngine = policy.NewEngineWithStore(policyStore)
+		profiles = policy.NewProfilesWithStore(database.NewProfileStoreAdapter(db))
+		policyEngine = policy.NewEngineWithStore(policyStore, profiles)
 		logger.Info("Policy engine initialized with database storage")
 	} else {
 		// Use config-based policies
-		policyEngine = policy.NewEngine(cfg.Policies)
+		profiles = policy.NewProfiles(cfg.PermissionProfiles)
+		policyEngine = policy.NewEngine(cfg.Policies, profiles)
 		logger.Info(fmt.Sprintf("Policy engine initialized with %d rules from config", len(cfg.Policies)))
 	}
 
-	// Initialize Harbor client
-	harborClient := harbor.NewClient(cfg.Harbor.URL, cfg.Harbor.Username, cfg.Harbor.Password)
+	// Initialize Harbor client and check that its identity has the permissions the broker needs
+	harborClient, err := newHarborClient(cfg.Harbor.URL, cfg.Harbor.HarborAuthConfig, harbor.TLSOptions{
+		CAFile:             cfg.Harbor.CAFile,
+		InsecureSkipVerify: cfg.Harbor.InsecureSkipVerify,
+	}, cfg.Harbor)
+	if err != nil {
+		logger.Error("Failed to initialize Harbor client", err)
+		os.Exit(1)
+	}
+	if err := verifyHarborIdentity(bgCtx, "harbor", harborClient, cfg.Harbor.PermissionCheck, logger); err != nil {
+		logger.Error("Harbor identity check failed", err)
+		os.Exit(1)
+	}
 	logger.Info("Harbor client initialized")
 
+	// Initialize registry backends; policies without a registry use the harbor section
+	registries := registry.NewSet()
+	registries.Add(registry.DefaultName, harborClient)
+	var distributionBackends []*distribution.Backend
+	for _, registryCfg := range cfg.Registries {
+		switch registryCfg.Type {
+		case "harbor":
+			// Every instance gets its own project cache and circuit breaker
+			client, err := newHarborClient(registryCfg.URL, registryCfg.HarborAuthConfig, harbor.TLSOptions{
+				CAFile:             registryCfg.CAFile,
+				InsecureSkipVerify: registryCfg.InsecureSkipVerify,
+			}, cfg.Harbor)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to initialize Harbor client of registry %s", registryCfg.Name), err)
+				os.Exit(1)
+			}
+			if err := verifyHarborIdentity(bgCtx, registryCfg.Name, client, registryCfg.PermissionCheck, logger); err != nil {
+				logger.Error(fmt.Sprintf("Harbor identity check of registry %s failed", registryCfg.Name), err)
+				os.Exit(1)
+			}
+			registries.Add(registryCfg.Name, client)
+			logger.Info(fmt.Sprintf("Harbor registry %s initialized (%s)", registryCfg.Name, client.Hostname()))
+		case "distribution":
+			signer, err := distribution.NewSigner(registryCfg.SigningKeyFile, registryCfg.CertificateFile, registryCfg.Issuer, registryCfg.Service, registryCfg.TokenTTL)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to load signing key of registry %s", registryCfg.Name), err)
+				os.Exit(1)
+			}
+			backend, err := distribution.NewBackend(registryCfg.Name, registryCfg.URL, signer)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to initialize registry %s", registryCfg.Name), err)
+				os.Exit(1)
+			}
+			registries.Add(registryCfg.Name, backend)
+			distributionBackends = append(distributionBackends, backend)
+			logger.Info(fmt.Sprintf("Distribution registry %s initialized (service %s)", registryCfg.Name, registryCfg.Service))
+		}
+	}
+
+	// Initialize API handler for UI; policies submitted via the API may only
+	// name configured registries and policy namespaces
+	if cfg.Database.Enabled {
+		namespaces := make(map[string][]string)
+		for _, source := range sources {
+			namespaces[source.PolicyNamespace] = append(namespaces[source.PolicyNamespace], source.Provider)
+		}
+		apiHandler = handler.NewAPIHandler(db, profiles, registries, namespaces, logger)
+	}
+
+	// Initialize robot reaper; it tracks issued robots for /revoke even when
+	// periodic reaping is disabled
+	var robotReaper *reaper.Reaper
+	if cfg.Database.Enabled {
+		robotStore := database.NewRobotStoreAdapter(db)
+		robotReaper = reaper.NewReaperWithStore(registries, robotStore, logger, cfg.Reaper.Interval, cfg.Reaper.OrphanSweep, cfg.Reaper.OrphanGrace)
+	} else {
+		robotReaper = reaper.NewReaper(registries, logger, cfg.Reaper.Interval, cfg.Reaper.OrphanSweep, cfg.Reaper.OrphanGrace)
+	}
+	if cfg.Reaper.Enabled {
+		go robotReaper.Run(bgCtx)
+	}
+
+	// Initialize the robot pool; pool robots are created or adopted before serving
+	var robotPool *pool.Pool
+	if cfg.Pool.Enabled {
+		entries := make([]pool.Entry, 0, len(cfg.Pool.Projects))
+		for _, project := range cfg.Pool.Projects {
+			access, err := profiles.Resolve(bgCtx, project.Permission)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Invalid permission for pool of project %s", project.HarborProject), err)
+				os.Exit(1)
+			}
+			entries = append(entries, pool.Entry{
+				HarborProject: project.HarborProject,
+				Permission:    project.Permission,
+				Access:        access,
+				Size:          project.Size,
+			})
+		}
+		robotPool = pool.NewPool(harborClient, logger, entries, cfg.Pool.InstanceID, cfg.Pool.RobotLifetime, cfg.Pool.ReclaimInterval)
+		if err := robotPool.Fill(bgCtx); err != nil {
+			logger.Error("Failed to fill robot pool", err)
+			os.Exit(1)
+		}
+		go robotPool.Run(bgCtx)
+		logger.Info(fmt.Sprintf("Robot pool of instance %s initialized for %d project(s)", cfg.Pool.InstanceID, len(entries)))
+	}
+
+	// Load the JWKS and keep it fresh so key rotations in GitLab are picked up without restarts
+	go jwtValidator.Run(bgCtx, logger)
+
+	// Initialize replay protection; used token IDs are shared through the database
+	var replayGuard *replay.Guard
+	if cfg.Security.ReplayProtection {
+		if cfg.Database.Enabled {
+			replayGuard = replay.NewGuardWithStore(database.NewReplayStoreAdapter(db))
+		} else {
+			replayGuard = replay.NewGuard()
+		}
+	}
+
 	// Initialize HTTP handler
-	httpHandler := handler.NewHandler(jwtValidator, policyEngine, harborClient, logger, cfg.Security.RobotTTLMinutes)
+	// The orphan sweep deletes unknown robots older than orphan_grace, so no
+	// credential may live longer than that, whatever a rule or job asks for
+	maxTTL := 0
+	if cfg.Reaper.OrphanSweep {
+		maxTTL = int(cfg.Reaper.OrphanGrace / time.Minute)
+	}
+	// Request contexts and shared issuances are cancelled if shutdown takes too long
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	httpHandler := handler.NewHandler(requestCtx, authenticator, policyEngine, profiles, registries, robotReaper, robotPool, replayGuard, logger, cfg.Security.RobotTTLMinutes, maxTTL)
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/token", httpHandler.HandleToken)
+	mux.HandleFunc("/revoke", httpHandler.HandleRevoke)
 	mux.HandleFunc("/health", httpHandler.HandleHealth)
+	mux.HandleFunc("/ready", httpHandler.HandleReady)
+	if len(distributionBackends) > 0 {
+		// Token endpoint that Distribution registries send docker clients to (auth.token.realm)
+		mux.Handle("/registry/token", distribution.NewTokenServer(distributionBackends, logger))
+	}
 
 	// Add API endpoints if database is enabled
 	if cfg.Database.Enabled && apiHandler != nil {
@@ -141,18 +323,46 @@ func main() {
 				w.WriteHeader(http.StatusNotFound)
 			}
 		}))
+		// Policy dry runs reveal rule contents, so browsers may only call them from
+		// the UI served here; no CORS headers
+		mux.HandleFunc("/api/policies/evaluate", httpHandler.HandleEvaluatePolicy)
+		mux.HandleFunc("/api/permission-profiles", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				apiHandler.HandleGetPermissionProfiles(w, r)
+			} else if r.Method == http.MethodPost {
+				apiHandler.HandleCreatePermissionProfile(w, r)
+			} else {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}))
+		mux.HandleFunc("/api/permission-profiles/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/api/permission-profiles/") && len(r.URL.Path) > len("/api/permission-profiles/") {
+				if r.Method == http.MethodPut {
+					apiHandler.HandleUpdatePermissionProfile(w, r)
+				} else if r.Method == http.MethodDelete {
+					apiHandler.HandleDeletePermissionProfile(w, r)
+				} else {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				}
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
 		// Serve static files from ui/dist directory
 		fs := http.FileServer(http.Dir("ui/dist"))
 		mux.Handle("/", fs)
 		logger.Info("API endpoints and static file server enabled")
 	}
 
-	// Create HTTP server
+	// Create HTTP server on the cancellable request context
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler:      mux,
+		Handler:      timeoutMiddleware(mux, cfg.Server.RequestTimeout),
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return requestCtx
+		},
 	}
 
 	// Start server in a goroutine
@@ -170,19 +380,118 @@ func main() {
 	<-quit
 
 	logger.Info("Shutting down server...")
+	bgCancel()
 
-	// Graceful shutdown with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Graceful shutdown with timeout; requests still running afterwards are
+	// cancelled, which stops their Harbor and database calls
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		logger.Error("Server forced to shutdown", err)
-		os.Exit(1)
+		logger.Info("Cancelling requests still running after the shutdown timeout")
+		cancelRequests()
+
+		// Give the cancelled handlers a moment to return and write their audit
+		// entries before the remaining connections are closed
+		graceCtx, graceCancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer graceCancel()
+		if err := server.Shutdown(graceCtx); err != nil {
+			server.Close()
+			logger.Error("Server forced to shutdown", err)
+			return
+		}
 	}
 
 	logger.Info("Server stopped")
 }
 
+// newHarborClient creates a Harbor client for an instance. Caching, retries and
+// the circuit breaker are configured by the harbor section.
+func newHarborClient(url string, authCfg config.HarborAuthConfig, tlsOptions harbor.TLSOptions, harborCfg config.HarborConfig) (*harbor.Client, error) {
+	auth, err := newHarborAuth(authCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return harbor.NewClient(url, auth, tlsOptions, harborCfg.ProjectCacheTTL, harborCfg.ProjectNegativeCacheTTL, harbor.RetryOptions{
+		CallTimeout:      harborCfg.CallTimeout,
+		MaxRetries:       harborCfg.MaxRetries,
+		BaseDelay:        harborCfg.RetryBaseDelay,
+		MaxDelay:         harborCfg.RetryMaxDelay,
+		FailureThreshold: harborCfg.CircuitFailureThreshold,
+		OpenDuration:     harborCfg.CircuitOpenDuration,
+	})
+}
+
+// newHarborAuth selects the auth provider for the configured auth type. Robot
+// accounts use their secret, OIDC users the CLI secret from a file, which is
+// re-read when Harbor regenerates it; basic auth uses a password or a file.
+func newHarborAuth(authCfg config.HarborAuthConfig) (harbor.AuthProvider, error) {
+	switch authCfg.AuthType {
+	case "robot":
+		if !strings.HasPrefix(authCfg.Username, "robot$") {
+			return nil, fmt.Errorf("username '%s' is not a robot account (robot$name)", authCfg.Username)
+		}
+	case "oidc_cli_secret":
+		if authCfg.PasswordFile == "" {
+			return nil, fmt.Errorf("auth type oidc_cli_secret requires a CLI secret file")
+		}
+		return harbor.NewSecretFileAuth(authCfg.Username, authCfg.PasswordFile)
+	case "basic":
+	default:
+		return nil, fmt.Errorf("unknown Harbor auth type '%s'", authCfg.AuthType)
+	}
+
+	if authCfg.PasswordFile != "" {
+		return harbor.NewSecretFileAuth(authCfg.Username, authCfg.PasswordFile)
+	}
+	return harbor.NewBasicAuth(authCfg.Username, authCfg.Password), nil
+}
+
+// verifyHarborIdentity compares the permissions of the broker's Harbor identity
+// with the ones it needs. Missing permissions are an error unless the check is
+// off; excess permissions, or failing to read them, are an error in strict mode
+// and logged in warn mode.
+func verifyHarborIdentity(ctx context.Context, name string, client *harbor.Client, mode string, logger *logging.Logger) error {
+	if mode == "off" {
+		return nil
+	}
+
+	report, err := client.VerifyPermissions(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to read permissions of the Harbor identity: %w", err)
+		if mode == "strict" {
+			return err
+		}
+		// Harbor may not be up yet; the broker retries its calls once it serves requests
+		logger.Error(fmt.Sprintf("Skipping permission check of %s", name), err)
+		return nil
+	}
+	if len(report.Missing) > 0 {
+		return fmt.Errorf("identity %s lacks permissions %s", report.Identity, harbor.FormatPermissions(report.Missing))
+	}
+	if len(report.Excess) > 0 {
+		if mode == "strict" {
+			return fmt.Errorf("identity %s has permissions the broker does not need: %s", report.Identity, harbor.FormatPermissions(report.Excess))
+		}
+		logger.Info(fmt.Sprintf("Harbor identity %s of %s has %d permission(s) the broker does not need; use a robot account with only %s", report.Identity, name, len(report.Excess), harbor.FormatPermissions(harbor.RequiredPermissions)))
+		return nil
+	}
+
+	logger.Info(fmt.Sprintf("Harbor identity %s of %s has exactly the required permissions", report.Identity, name))
+	return nil
+}
+
+// timeoutMiddleware bounds the context of every request by timeout
+func timeoutMiddleware(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // corsMiddleware adds CORS headers for frontend development
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
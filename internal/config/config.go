@@ -3,9 +3,15 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/pattern"
 )
 
 // Config represents the application configuration
@@ -15,7 +21,21 @@ type Config struct {
 	Harbor   HarborConfig   `yaml:"harbor"`
 	Security SecurityConfig `yaml:"security"`
 	Database DatabaseConfig `yaml:"database"`
+	Reaper   ReaperConfig   `yaml:"reaper"`
+	Pool     PoolConfig     `yaml:"pool"`
 	Policies []PolicyRule   `yaml:"policies"`
+
+	// Registries lists further registries besides the Harbor instance of the
+	// harbor section, e.g. regional Harbor instances. Policies bind projects to
+	// one by name, and jobs select it in their token request.
+	Registries []RegistryConfig `yaml:"registries"`
+
+	// IdentitySources lists the GitLab instances whose tokens are accepted.
+	// If empty, the gitlab section is used as the only source.
+	IdentitySources []IdentitySourceConfig `yaml:"identity_sources"`
+
+	// PermissionProfiles maps custom permission names to Harbor access actions
+	PermissionProfiles map[string][]AccessRule `yaml:"permission_profiles"`
 }
 
 // ServerConfig contains HTTP server settings
@@ -23,6 +43,9 @@ type ServerConfig struct {
 	Port         int           `yaml:"port"`
 	ReadTimeout  time.Duration `yaml:"read_timeout"`
 	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	RequestTimeout  time.Duration `yaml:"request_timeout"`  // deadline for all work of a request, including Harbor and database calls
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // how long in-flight requests may finish before they are cancelled
 }
 
 // GitLabConfig contains GitLab OIDC settings
@@ -31,31 +54,201 @@ type GitLabConfig struct {
 	Audience    string   `yaml:"audience"`
 	JWKSUrl     string   `yaml:"jwks_url"`
 	Issuers     []string `yaml:"issuers"`
+
+	JWKSRefreshInterval    time.Duration `yaml:"jwks_refresh_interval"`     // background refresh period
+	JWKSMinRefreshInterval time.Duration `yaml:"jwks_min_refresh_interval"` // rate limit for refetches on unknown kid
+	JWKSMaxStale           time.Duration `yaml:"jwks_max_stale"`            // how long to serve the last good key set when refreshes fail
+}
+
+// IdentitySourceConfig describes a CI system (GitLab instance or GitHub Actions) whose tokens are accepted
+type IdentitySourceConfig struct {
+	Name            string `yaml:"name"`
+	Provider        string `yaml:"provider"` // "gitlab" (default) or "github"
+	Issuer          string `yaml:"issuer"`
+	Audience        string `yaml:"audience"`
+	JWKSUrl         string `yaml:"jwks_url"`         // overrides the jwks_uri from discovery
+	PolicyNamespace string `yaml:"policy_namespace"` // defaults to name
+
+	// For clusters whose discovery endpoint is not reachable or uses a private CA
+	JWKSFile          string   `yaml:"jwks_file"`          // local JWKS file, used instead of discovery
+	CAFile            string   `yaml:"ca_file"`            // CA bundle for TLS to the issuer
+	SigningAlgorithms []string `yaml:"signing_algorithms"` // accepted with jwks_file (default: RS256)
 }
 
 // HarborConfig contains Harbor API settings
 type HarborConfig struct {
-	URL      string `yaml:"url"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	URL              string `yaml:"url"`
+	HarborAuthConfig `yaml:",inline"`
+
+	CAFile             string `yaml:"ca_file"`              // CA bundle for TLS to Harbor
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // skip TLS verification; for test instances only
+
+	ProjectCacheTTL         time.Duration `yaml:"project_cache_ttl"`          // how long project IDs are cached
+	ProjectNegativeCacheTTL time.Duration `yaml:"project_negative_cache_ttl"` // how long missing projects are cached
+
+	CallTimeout             time.Duration `yaml:"call_timeout"`              // deadline of a single Harbor call attempt
+	MaxRetries              int           `yaml:"max_retries"`               // retries of a failed Harbor call
+	RetryBaseDelay          time.Duration `yaml:"retry_base_delay"`          // backoff before the first retry
+	RetryMaxDelay           time.Duration `yaml:"retry_max_delay"`           // upper bound of the backoff
+	CircuitFailureThreshold int           `yaml:"circuit_failure_threshold"` // consecutive failures that open the circuit
+	CircuitOpenDuration     time.Duration `yaml:"circuit_open_duration"`     // how long /token fails fast once the circuit is open
+}
+
+// RegistryConfig describes a registry backend that policies can name
+type RegistryConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // "harbor" or "distribution"
+	URL  string `yaml:"url"`
+
+	// For type harbor; retries, caching and the circuit breaker follow the harbor section
+	HarborAuthConfig   `yaml:",inline"`
+	CAFile             string `yaml:"ca_file"`              // CA bundle for TLS to Harbor
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // skip TLS verification; for test instances only
+
+	// For type distribution, where the broker is the registry's token-auth service
+	Service         string        `yaml:"service"`          // auth.token.service of the registry
+	Issuer          string        `yaml:"issuer"`           // auth.token.issuer of the registry
+	SigningKeyFile  string        `yaml:"signing_key_file"` // PEM RSA or ECDSA private key
+	CertificateFile string        `yaml:"certificate_file"` // PEM certificate of the key, listed in auth.token.rootcertbundle
+	TokenTTL        time.Duration `yaml:"token_ttl"`        // lifetime of registry bearer tokens
+}
+
+// HarborAuthConfig sets the identity the broker uses for a Harbor instance
+type HarborAuthConfig struct {
+	AuthType     string `yaml:"auth_type"`     // "basic" (default), "robot" or "oidc_cli_secret"
+	Username     string `yaml:"username"`      // user, robot account (robot$name) or OIDC user name
+	Password     string `yaml:"password"`      // password, robot secret or CLI secret
+	PasswordFile string `yaml:"password_file"` // read the password from a file instead, re-read when it changes
+
+	// PermissionCheck compares the identity's permissions with the ones the broker
+	// needs at startup: "strict" fails on missing or excess permissions, "warn"
+	// fails on missing and logs excess ones, "off" skips the check.
+	// Defaults to "strict" for robot accounts and "warn" otherwise.
+	PermissionCheck string `yaml:"permission_check"`
+}
+
+// validate checks the auth settings; section names the config section in errors
+func (a *HarborAuthConfig) validate(section string) error {
+	switch a.AuthType {
+	case "basic", "robot", "oidc_cli_secret":
+	default:
+		return fmt.Errorf("%s.auth_type must be one of: basic, robot, oidc_cli_secret", section)
+	}
+	if a.Username == "" {
+		return fmt.Errorf("%s.username is required", section)
+	}
+	if a.Password == "" && a.PasswordFile == "" {
+		return fmt.Errorf("%s.password or %s.password_file is required", section, section)
+	}
+	if a.Password != "" && a.PasswordFile != "" {
+		return fmt.Errorf("%s: only one of password or password_file may be set", section)
+	}
+	if a.AuthType == "robot" && !strings.HasPrefix(a.Username, "robot$") {
+		return fmt.Errorf("%s.username must name a robot account (robot$name) for auth_type robot", section)
+	}
+	if a.AuthType == "oidc_cli_secret" && a.PasswordFile == "" {
+		// CLI secrets are regenerated on every OIDC login and must be picked up without a restart
+		return fmt.Errorf("%s.password_file is required for auth_type oidc_cli_secret", section)
+	}
+	if a.PermissionCheck != "strict" && a.PermissionCheck != "warn" && a.PermissionCheck != "off" {
+		return fmt.Errorf("%s.permission_check must be one of: strict, warn, off", section)
+	}
+	return nil
+}
+
+// setDefaults fills in the auth type and the permission check mode
+func (a *HarborAuthConfig) setDefaults() {
+	if a.AuthType == "" {
+		a.AuthType = "basic"
+	}
+	if a.PermissionCheck == "" {
+		if a.AuthType == "robot" {
+			a.PermissionCheck = "strict"
+		} else {
+			a.PermissionCheck = "warn"
+		}
+	}
 }
 
 // SecurityConfig contains security settings
 type SecurityConfig struct {
 	RobotTTLMinutes int `yaml:"robot_ttl_minutes"`
+
+	// ReplayProtection rejects CI tokens that are presented more than once,
+	// unless the matching policy deduplicates replays
+	ReplayProtection bool `yaml:"replay_protection"`
 }
 
 // DatabaseConfig contains database connection settings
 type DatabaseConfig struct {
-	ConnectionString string `yaml:"connection_string"`
-	Enabled          bool   `yaml:"enabled"`
+	ConnectionString string        `yaml:"connection_string"`
+	Enabled          bool          `yaml:"enabled"`
+	QueryTimeout     time.Duration `yaml:"query_timeout"` // deadline of a single query
+}
+
+// ReaperConfig contains settings for deleting expired robot accounts from Harbor
+type ReaperConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Interval    time.Duration `yaml:"interval"`
+	OrphanSweep bool          `yaml:"orphan_sweep"`
+	OrphanGrace time.Duration `yaml:"orphan_grace"`
+}
+
+// PoolConfig contains settings for pre-provisioned robot accounts that are
+// handed out by rotating their secret instead of creating a robot per request
+type PoolConfig struct {
+	Enabled         bool                `yaml:"enabled"`
+	InstanceID      string              `yaml:"instance_id"`      // part of this instance's pool robot names; default: hostname
+	RobotLifetime   time.Duration       `yaml:"robot_lifetime"`   // how long pool robots are valid in Harbor before they are replaced
+	ReclaimInterval time.Duration       `yaml:"reclaim_interval"` // how often expired leases are reclaimed
+	Projects        []PoolProjectConfig `yaml:"projects"`
+}
+
+// instanceIDPattern matches instance IDs that are valid in Harbor robot names
+var instanceIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// defaultInstanceID derives a pool instance ID from the hostname
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	id := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(hostname))
+	return strings.Trim(id, "-")
+}
+
+// PoolProjectConfig sets the pool size for a Harbor project and permission
+type PoolProjectConfig struct {
+	HarborProject string `yaml:"harbor_project"`
+	Permission    string `yaml:"permission"` // built-in permission or profile name
+	Size          int    `yaml:"size"`
 }
 
 // PolicyRule defines authorization rules
 type PolicyRule struct {
-	GitLabProject  string   `yaml:"gitlab_project"`
-	HarborProjects []string `yaml:"harbor_projects"`
-	AllowedPerms   []string `yaml:"allowed_permissions"`
+	Name            string            `yaml:"name"`
+	Effect          string            `yaml:"effect"`           // "allow" (default) or "deny"
+	PolicyNamespace string            `yaml:"policy_namespace"` // identity source the rule applies to
+	GitLabProject   string            `yaml:"gitlab_project"`   // exact path or pattern, e.g. "platform/**"
+	HarborProjects  []string          `yaml:"harbor_projects"`  // may use ${namespace}, ${group}, ${project}
+	AllowedPerms    []string          `yaml:"allowed_permissions"`
+	Conditions      map[string]string `yaml:"conditions"`          // claim name -> required value (glob)
+	MaxTTL          int               `yaml:"max_ttl_minutes"`     // 0 = no per-rule limit
+	DefaultTTL      int               `yaml:"default_ttl_minutes"` // 0 = security.robot_ttl_minutes
+	OnReplay        string            `yaml:"on_replay"`           // "reject" (default) or "deduplicate"
+	RobotScope      string            `yaml:"robot_scope"`         // "job" (default) or "pipeline"
+	Registry        string            `yaml:"registry"`            // registries entry; empty = harbor section
+}
+
+// AccessRule is a single Harbor resource/action pair of a permission profile
+type AccessRule struct {
+	Resource string `yaml:"resource"`
+	Action   string `yaml:"action"`
 }
 
 // Load reads and parses the configuration file
@@ -80,9 +273,83 @@ func Load(path string) (*Config, error) {
 	if cfg.Server.WriteTimeout == 0 {
 		cfg.Server.WriteTimeout = 10 * time.Second
 	}
+	if cfg.Server.RequestTimeout == 0 {
+		// The response cannot be written after the write timeout anyway
+		cfg.Server.RequestTimeout = cfg.Server.WriteTimeout
+	}
+	if cfg.Server.ShutdownTimeout == 0 {
+		cfg.Server.ShutdownTimeout = 10 * time.Second
+	}
+	if cfg.Database.QueryTimeout == 0 {
+		cfg.Database.QueryTimeout = 5 * time.Second
+	}
 	if cfg.Security.RobotTTLMinutes == 0 {
 		cfg.Security.RobotTTLMinutes = 10
 	}
+	if cfg.GitLab.JWKSRefreshInterval == 0 {
+		cfg.GitLab.JWKSRefreshInterval = 1 * time.Hour
+	}
+	if cfg.GitLab.JWKSMinRefreshInterval == 0 {
+		cfg.GitLab.JWKSMinRefreshInterval = 30 * time.Second
+	}
+	if cfg.GitLab.JWKSMaxStale == 0 {
+		cfg.GitLab.JWKSMaxStale = 24 * time.Hour
+	}
+	for i := range cfg.IdentitySources {
+		if cfg.IdentitySources[i].Provider == "" {
+			cfg.IdentitySources[i].Provider = identity.ProviderGitLab
+		}
+		if cfg.IdentitySources[i].PolicyNamespace == "" {
+			cfg.IdentitySources[i].PolicyNamespace = cfg.IdentitySources[i].Name
+		}
+	}
+	if cfg.Reaper.Interval == 0 {
+		cfg.Reaper.Interval = 1 * time.Minute
+	}
+	if cfg.Reaper.OrphanGrace == 0 {
+		cfg.Reaper.OrphanGrace = 1 * time.Hour
+	}
+	if cfg.Harbor.ProjectCacheTTL == 0 {
+		cfg.Harbor.ProjectCacheTTL = 10 * time.Minute
+	}
+	if cfg.Harbor.ProjectNegativeCacheTTL == 0 {
+		cfg.Harbor.ProjectNegativeCacheTTL = 30 * time.Second
+	}
+	if cfg.Harbor.CallTimeout == 0 {
+		cfg.Harbor.CallTimeout = 10 * time.Second
+	}
+	if cfg.Harbor.MaxRetries == 0 {
+		cfg.Harbor.MaxRetries = 3
+	}
+	if cfg.Harbor.RetryBaseDelay == 0 {
+		cfg.Harbor.RetryBaseDelay = 200 * time.Millisecond
+	}
+	if cfg.Harbor.RetryMaxDelay == 0 {
+		cfg.Harbor.RetryMaxDelay = 5 * time.Second
+	}
+	if cfg.Harbor.CircuitFailureThreshold == 0 {
+		cfg.Harbor.CircuitFailureThreshold = 5
+	}
+	if cfg.Harbor.CircuitOpenDuration == 0 {
+		cfg.Harbor.CircuitOpenDuration = 30 * time.Second
+	}
+	if cfg.Pool.ReclaimInterval == 0 {
+		cfg.Pool.ReclaimInterval = 30 * time.Second
+	}
+	if cfg.Pool.InstanceID == "" {
+		cfg.Pool.InstanceID = defaultInstanceID()
+	}
+	if cfg.Pool.RobotLifetime == 0 {
+		cfg.Pool.RobotLifetime = 7 * 24 * time.Hour
+	}
+	for i := range cfg.Registries {
+		if cfg.Registries[i].Type == "harbor" {
+			cfg.Registries[i].setDefaults()
+		}
+		if cfg.Registries[i].TokenTTL == 0 {
+			cfg.Registries[i].TokenTTL = 5 * time.Minute
+		}
+	}
 
 	// Override with environment variables if set
 	if harborUser := os.Getenv("HARBOR_USERNAME"); harborUser != "" {
@@ -90,10 +357,12 @@ func Load(path string) (*Config, error) {
 	}
 	if harborPass := os.Getenv("HARBOR_PASSWORD"); harborPass != "" {
 		cfg.Harbor.Password = harborPass
+		cfg.Harbor.PasswordFile = ""
 	}
 	if dbConnStr := os.Getenv("DATABASE_URL"); dbConnStr != "" {
 		cfg.Database.ConnectionString = dbConnStr
 	}
+	cfg.Harbor.setDefaults()
 
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -104,46 +373,236 @@ func Load(path string) (*Config, error) {
 
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
-	if c.GitLab.InstanceURL == "" {
-		return fmt.Errorf("gitlab.instance_url is required")
+	if len(c.IdentitySources) == 0 {
+		if c.GitLab.InstanceURL == "" {
+			return fmt.Errorf("gitlab.instance_url is required")
+		}
+		if c.GitLab.Audience == "" {
+			return fmt.Errorf("gitlab.audience is required")
+		}
 	}
-	if c.GitLab.Audience == "" {
-		return fmt.Errorf("gitlab.audience is required")
+	sourceNames := make(map[string]bool)
+	for i, source := range c.IdentitySources {
+		if source.Name == "" || source.Issuer == "" || source.Audience == "" {
+			return fmt.Errorf("identity_sources[%d]: name, issuer and audience are required", i)
+		}
+		if _, ok := identity.LookupProvider(source.Provider); !ok {
+			return fmt.Errorf("identity_sources[%d]: unknown provider '%s' (must be one of: %s)", i, source.Provider, strings.Join(identity.ProviderNames(), ", "))
+		}
+		if source.JWKSFile != "" && source.JWKSUrl != "" {
+			return fmt.Errorf("identity_sources[%d]: only one of jwks_url or jwks_file may be set", i)
+		}
+		if len(source.SigningAlgorithms) > 0 && source.JWKSFile == "" {
+			return fmt.Errorf("identity_sources[%d]: signing_algorithms requires jwks_file; discovery provides them otherwise", i)
+		}
+		if sourceNames[source.Name] {
+			return fmt.Errorf("identity_sources[%d]: duplicate name '%s'", i, source.Name)
+		}
+		sourceNames[source.Name] = true
+	}
+	if c.GitLab.JWKSRefreshInterval < 0 || c.GitLab.JWKSMinRefreshInterval < 0 {
+		return fmt.Errorf("gitlab.jwks_refresh_interval and gitlab.jwks_min_refresh_interval must be positive")
+	}
+	if c.GitLab.JWKSMaxStale > 0 && c.GitLab.JWKSMaxStale < c.GitLab.JWKSRefreshInterval {
+		return fmt.Errorf("gitlab.jwks_max_stale must be at least gitlab.jwks_refresh_interval")
 	}
 	if c.Harbor.URL == "" {
 		return fmt.Errorf("harbor.url is required")
 	}
-	if c.Harbor.Username == "" {
-		return fmt.Errorf("harbor.username is required")
+	if err := c.Harbor.validate("harbor"); err != nil {
+		return err
+	}
+	if c.Harbor.ProjectCacheTTL < 0 || c.Harbor.ProjectNegativeCacheTTL < 0 {
+		return fmt.Errorf("harbor.project_cache_ttl and harbor.project_negative_cache_ttl must not be negative")
+	}
+	if c.Harbor.CallTimeout < 0 {
+		return fmt.Errorf("harbor.call_timeout must be positive")
 	}
-	if c.Harbor.Password == "" {
-		return fmt.Errorf("harbor.password is required")
+	if c.Harbor.MaxRetries < 0 || c.Harbor.RetryBaseDelay < 0 || c.Harbor.RetryMaxDelay < 0 {
+		return fmt.Errorf("harbor.max_retries, harbor.retry_base_delay and harbor.retry_max_delay must not be negative")
+	}
+	if c.Harbor.RetryMaxDelay < c.Harbor.RetryBaseDelay {
+		return fmt.Errorf("harbor.retry_max_delay must be at least harbor.retry_base_delay")
+	}
+	if c.Harbor.CircuitFailureThreshold < 0 || c.Harbor.CircuitOpenDuration < 0 {
+		return fmt.Errorf("harbor.circuit_failure_threshold and harbor.circuit_open_duration must not be negative")
+	}
+	if c.Server.RequestTimeout < 0 || c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("server.request_timeout and server.shutdown_timeout must be positive")
+	}
+	if c.Database.QueryTimeout < 0 {
+		return fmt.Errorf("database.query_timeout must be positive")
 	}
 	if c.Database.Enabled && c.Database.ConnectionString == "" {
 		return fmt.Errorf("database.connection_string is required when database is enabled")
 	}
+	if c.Reaper.Enabled && c.Reaper.Interval < 0 {
+		return fmt.Errorf("reaper.interval must be positive")
+	}
+	if c.Reaper.OrphanSweep && c.Reaper.OrphanGrace < time.Duration(c.Security.RobotTTLMinutes)*time.Minute {
+		return fmt.Errorf("reaper.orphan_grace must be at least security.robot_ttl_minutes")
+	}
+	// Issued TTLs are capped at the grace; file-based rules must fit into it
+	if c.Reaper.OrphanSweep {
+		for i, rule := range c.Policies {
+			if time.Duration(max(rule.MaxTTL, rule.DefaultTTL))*time.Minute > c.Reaper.OrphanGrace {
+				return fmt.Errorf("policy[%d]: max_ttl_minutes and default_ttl_minutes must not exceed reaper.orphan_grace", i)
+			}
+		}
+	}
+	if c.Pool.Enabled {
+		if c.Pool.ReclaimInterval < 0 {
+			return fmt.Errorf("pool.reclaim_interval must be positive")
+		}
+		if !instanceIDPattern.MatchString(c.Pool.InstanceID) {
+			return fmt.Errorf("pool.instance_id '%s' must consist of lowercase letters, digits and '-'", c.Pool.InstanceID)
+		}
+		// Idle robots are replaced a day before Harbor expires them
+		if c.Pool.RobotLifetime < 48*time.Hour {
+			return fmt.Errorf("pool.robot_lifetime must be at least 48h")
+		}
+		seen := make(map[string]bool, len(c.Pool.Projects))
+		for i, project := range c.Pool.Projects {
+			if project.HarborProject == "" || project.Permission == "" {
+				return fmt.Errorf("pool.projects[%d]: harbor_project and permission are required", i)
+			}
+			if project.Size <= 0 {
+				return fmt.Errorf("pool.projects[%d]: size must be positive", i)
+			}
+			key := project.HarborProject + "/" + project.Permission
+			if seen[key] {
+				return fmt.Errorf("pool.projects[%d]: duplicate pool for %s with permission %s", i, project.HarborProject, project.Permission)
+			}
+			seen[key] = true
+		}
+	}
+	registryNames := make(map[string]bool)
+	for i, registry := range c.Registries {
+		if registry.Name == "" || registry.URL == "" {
+			return fmt.Errorf("registries[%d]: name and url are required", i)
+		}
+		if registry.Name == "harbor" {
+			return fmt.Errorf("registries[%d]: 'harbor' refers to the harbor section and cannot be used as a name", i)
+		}
+		if registryNames[registry.Name] {
+			return fmt.Errorf("registries[%d]: duplicate name '%s'", i, registry.Name)
+		}
+		registryNames[registry.Name] = true
+		switch registry.Type {
+		case "harbor":
+			if err := registry.HarborAuthConfig.validate(fmt.Sprintf("registries[%d]", i)); err != nil {
+				return err
+			}
+		case "distribution":
+			if registry.Service == "" || registry.Issuer == "" || registry.SigningKeyFile == "" || registry.CertificateFile == "" {
+				return fmt.Errorf("registries[%d]: service, issuer, signing_key_file and certificate_file are required", i)
+			}
+			if registry.TokenTTL < 0 {
+				return fmt.Errorf("registries[%d]: token_ttl must be positive", i)
+			}
+		default:
+			return fmt.Errorf("registries[%d]: unknown type '%s' (must be one of: harbor, distribution)", i, registry.Type)
+		}
+	}
 	if !c.Database.Enabled && len(c.Policies) == 0 {
 		return fmt.Errorf("at least one policy rule is required when database is disabled")
 	}
 
+	// Validate permission profiles
+	for name, rules := range c.PermissionProfiles {
+		if name == "read" || name == "write" || name == "read-write" {
+			return fmt.Errorf("permission_profiles: '%s' is a built-in profile and cannot be redefined", name)
+		}
+		if len(rules) == 0 {
+			return fmt.Errorf("permission_profiles.%s: access list must not be empty", name)
+		}
+		for j, rule := range rules {
+			if rule.Resource == "" || rule.Action == "" {
+				return fmt.Errorf("permission_profiles.%s[%d]: resource and action are required", name, j)
+			}
+		}
+	}
+
 	// Validate policy rules
 	for i, rule := range c.Policies {
 		if rule.GitLabProject == "" {
 			return fmt.Errorf("policy[%d]: gitlab_project is required", i)
 		}
+		providers := c.namespaceProviders(rule.PolicyNamespace)
+		if len(providers) == 0 {
+			return fmt.Errorf("policy[%d]: policy_namespace '%s' does not belong to any identity source", i, rule.PolicyNamespace)
+		}
+		if err := pattern.ValidateProject(rule.GitLabProject); err != nil {
+			return fmt.Errorf("policy[%d]: %w", i, err)
+		}
 		if len(rule.HarborProjects) == 0 {
 			return fmt.Errorf("policy[%d]: harbor_projects must not be empty", i)
 		}
-		if len(rule.AllowedPerms) == 0 {
+		for _, harborProject := range rule.HarborProjects {
+			if err := pattern.ValidateTemplate(harborProject); err != nil {
+				return fmt.Errorf("policy[%d]: %w", i, err)
+			}
+		}
+		if rule.Effect != "" && rule.Effect != "allow" && rule.Effect != "deny" {
+			return fmt.Errorf("policy[%d]: invalid effect '%s'", i, rule.Effect)
+		}
+		// Deny rules without permissions deny every permission
+		if len(rule.AllowedPerms) == 0 && rule.Effect != "deny" {
 			return fmt.Errorf("policy[%d]: allowed_permissions must not be empty", i)
 		}
 		// Validate permissions
 		for _, perm := range rule.AllowedPerms {
-			if perm != "read" && perm != "write" && perm != "read-write" {
+			if _, ok := c.PermissionProfiles[perm]; !ok && perm != "read" && perm != "write" && perm != "read-write" {
 				return fmt.Errorf("policy[%d]: invalid permission '%s'", i, perm)
 			}
 		}
+		// Validate TTL limits
+		if rule.MaxTTL < 0 || rule.DefaultTTL < 0 {
+			return fmt.Errorf("policy[%d]: TTL values must not be negative", i)
+		}
+		if rule.MaxTTL > 0 && rule.DefaultTTL > rule.MaxTTL {
+			return fmt.Errorf("policy[%d]: default_ttl_minutes must not exceed max_ttl_minutes", i)
+		}
+		if rule.OnReplay != "" && rule.OnReplay != "reject" && rule.OnReplay != "deduplicate" {
+			return fmt.Errorf("policy[%d]: invalid on_replay '%s'", i, rule.OnReplay)
+		}
+		if rule.RobotScope != "" && rule.RobotScope != "job" && rule.RobotScope != "pipeline" {
+			return fmt.Errorf("policy[%d]: invalid robot_scope '%s'", i, rule.RobotScope)
+		}
+		if rule.Registry != "" && !registryNames[rule.Registry] {
+			return fmt.Errorf("policy[%d]: registry '%s' is not configured", i, rule.Registry)
+		}
+		// Validate conditions
+		for claim, value := range rule.Conditions {
+			for _, provider := range providers {
+				if !identity.IsConditionClaim(provider, claim) {
+					return fmt.Errorf("policy[%d]: unsupported condition claim '%s' for provider %s", i, claim, provider)
+				}
+			}
+			if _, err := path.Match(value, ""); err != nil {
+				return fmt.Errorf("policy[%d]: invalid condition pattern '%s' for claim '%s'", i, value, claim)
+			}
+		}
 	}
 
 	return nil
 }
+
+// namespaceProviders returns the identity providers of the sources using a policy namespace.
+// Without identity_sources, only the empty namespace of the gitlab section exists.
+func (c *Config) namespaceProviders(namespace string) []string {
+	if len(c.IdentitySources) == 0 {
+		if namespace == "" {
+			return []string{identity.ProviderGitLab}
+		}
+		return nil
+	}
+
+	var providers []string
+	for _, source := range c.IdentitySources {
+		if source.PolicyNamespace == namespace {
+			providers = append(providers, source.Provider)
+		}
+	}
+	return providers
+}
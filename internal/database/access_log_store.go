@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"time"
 )
 
@@ -33,6 +34,14 @@ func (a *AccessLogStoreAdapter) LogAccess(logData interface{}) error {
 		log.Timestamp = time.Now()
 	}
 
+	if src, ok := data["identity_source"].(string); ok {
+		log.IdentitySource = src
+	}
+
+	if ns, ok := data["policy_namespace"].(string); ok {
+		log.PolicyNamespace = ns
+	}
+
 	if gp, ok := data["gitlab_project"].(string); ok {
 		log.GitLabProject = gp
 	}
@@ -57,6 +66,10 @@ func (a *AccessLogStoreAdapter) LogAccess(logData interface{}) error {
 		log.ExpiresAt = &ea
 	}
 
+	if ttl, ok := data["ttl_minutes"].(int); ok {
+		log.TTLMinutes = &ttl
+	}
+
 	if pid, ok := data["pipeline_id"].(string); ok {
 		log.PipelineID = &pid
 	}
@@ -65,6 +78,14 @@ func (a *AccessLogStoreAdapter) LogAccess(logData interface{}) error {
 		log.JobID = &jid
 	}
 
+	if scope, ok := data["robot_scope"].(string); ok {
+		log.RobotScope = scope
+	}
+
+	if registry, ok := data["registry"].(string); ok {
+		log.Registry = registry
+	}
+
 	if status, ok := data["status"].(string); ok {
 		log.Status = status
 	}
@@ -73,5 +94,6 @@ func (a *AccessLogStoreAdapter) LogAccess(logData interface{}) error {
 		log.ErrorMessage = &errMsg
 	}
 
-	return a.db.LogAccess(log)
+	// Audit entries are written even if the request that caused them was cancelled
+	return a.db.LogAccess(context.Background(), log)
 }
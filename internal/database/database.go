@@ -1,53 +1,74 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
 )
 
 // DB wraps the database connection
 type DB struct {
-	conn *sql.DB
+	conn         *sql.DB
+	queryTimeout time.Duration
 }
 
 // AccessLog represents an access log entry
 type AccessLog struct {
-	ID            int64     `json:"id"`
-	Timestamp     time.Time `json:"timestamp"`
-	GitLabProject string    `json:"gitlab_project"`
-	HarborProject string    `json:"harbor_project"`
-	Permission    string    `json:"permission"`
-	RobotID       *int64    `json:"robot_id,omitempty"`
-	RobotName     *string   `json:"robot_name,omitempty"`
-	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
-	PipelineID    *string   `json:"pipeline_id,omitempty"`
-	JobID         *string   `json:"job_id,omitempty"`
-	Status        string    `json:"status"`
-	ErrorMessage  *string   `json:"error_message,omitempty"`
+	ID              int64      `json:"id"`
+	Timestamp       time.Time  `json:"timestamp"`
+	IdentitySource  string     `json:"identity_source,omitempty"`
+	PolicyNamespace string     `json:"policy_namespace,omitempty"`
+	GitLabProject   string     `json:"gitlab_project"`
+	HarborProject   string     `json:"harbor_project"`
+	Permission      string     `json:"permission"`
+	RobotID         *int64     `json:"robot_id,omitempty"`
+	RobotName       *string    `json:"robot_name,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	TTLMinutes      *int       `json:"ttl_minutes,omitempty"`
+	PipelineID      *string    `json:"pipeline_id,omitempty"`
+	JobID           *string    `json:"job_id,omitempty"`
+	RobotScope      string     `json:"robot_scope,omitempty"`
+	Registry        string     `json:"registry,omitempty"`
+	Status          string     `json:"status"`
+	ErrorMessage    *string    `json:"error_message,omitempty"`
 }
 
 // PolicyRule represents a policy rule
 type PolicyRule struct {
-	ID                 int64     `json:"id"`
-	GitLabProject      string    `json:"gitlab_project"`
-	HarborProjects     []string  `json:"harbor_projects"`
-	AllowedPermissions []string  `json:"allowed_permissions"`
-	CreatedAt          time.Time `json:"created_at"`
-	UpdatedAt          time.Time `json:"updated_at"`
+	ID                 int64             `json:"id"`
+	Effect             string            `json:"effect"` // "allow" or "deny"
+	PolicyNamespace    string            `json:"policy_namespace"`
+	GitLabProject      string            `json:"gitlab_project"`
+	HarborProjects     []string          `json:"harbor_projects"`
+	AllowedPermissions []string          `json:"allowed_permissions"`
+	Conditions         map[string]string `json:"conditions,omitempty"`
+	MaxTTLMinutes      int               `json:"max_ttl_minutes,omitempty"`
+	DefaultTTLMinutes  int               `json:"default_ttl_minutes,omitempty"`
+	OnReplay           string            `json:"on_replay,omitempty"`   // "reject" (default) or "deduplicate"
+	RobotScope         string            `json:"robot_scope,omitempty"` // "job" (default) or "pipeline"
+	Registry           string            `json:"registry,omitempty"`    // configured registry name; empty = harbor section
+	CreatedAt          time.Time         `json:"created_at"`
+	UpdatedAt          time.Time         `json:"updated_at"`
 }
 
-// NewDB creates a new database connection
-func NewDB(connectionString string) (*DB, error) {
+// NewDB creates a new database connection. Every query is bounded by queryTimeout
+// in addition to the caller's context; migrations are not.
+func NewDB(ctx context.Context, connectionString string, queryTimeout time.Duration) (*DB, error) {
 	conn, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Test connection
-	if err := conn.Ping(); err != nil {
+	pingCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	if err := conn.PingContext(pingCtx); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
@@ -56,7 +77,7 @@ func NewDB(connectionString string) (*DB, error) {
 	conn.SetMaxIdleConns(5)
 	conn.SetConnMaxLifetime(5 * time.Minute)
 
-	return &DB{conn: conn}, nil
+	return &DB{conn: conn, queryTimeout: queryTimeout}, nil
 }
 
 // Close closes the database connection
@@ -64,9 +85,14 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
+// withTimeout bounds a query by the configured query timeout
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
 // RunMigrations executes database migrations
-func (db *DB) RunMigrations(migrationSQL string) error {
-	_, err := db.conn.Exec(migrationSQL)
+func (db *DB) RunMigrations(ctx context.Context, migrationSQL string) error {
+	_, err := db.conn.ExecContext(ctx, migrationSQL)
 	if err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
@@ -74,26 +100,35 @@ func (db *DB) RunMigrations(migrationSQL string) error {
 }
 
 // LogAccess stores an access log entry
-func (db *DB) LogAccess(log *AccessLog) error {
+func (db *DB) LogAccess(ctx context.Context, log *AccessLog) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		INSERT INTO access_logs 
-		(timestamp, gitlab_project, harbor_project, permission, robot_id, robot_name, 
-		 expires_at, pipeline_id, job_id, status, error_message)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		(timestamp, identity_source, policy_namespace, gitlab_project, harbor_project, permission, robot_id, robot_name, 
+		 expires_at, ttl_minutes, pipeline_id, job_id, robot_scope, registry, status, error_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 		RETURNING id
 	`
 
-	err := db.conn.QueryRow(
+	err := db.conn.QueryRowContext(
+		ctx,
 		query,
 		log.Timestamp,
+		log.IdentitySource,
+		log.PolicyNamespace,
 		log.GitLabProject,
 		log.HarborProject,
 		log.Permission,
 		log.RobotID,
 		log.RobotName,
 		log.ExpiresAt,
+		log.TTLMinutes,
 		log.PipelineID,
 		log.JobID,
+		log.RobotScope,
+		log.Registry,
 		log.Status,
 		log.ErrorMessage,
 	).Scan(&log.ID)
@@ -106,12 +141,27 @@ func (db *DB) LogAccess(log *AccessLog) error {
 }
 
 // GetAccessLogs retrieves access logs with pagination and optional filters
-func (db *DB) GetAccessLogs(limit, offset int, filters map[string]string) ([]AccessLog, int, error) {
+func (db *DB) GetAccessLogs(ctx context.Context, limit, offset int, filters map[string]string) ([]AccessLog, int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	// Build WHERE clause based on filters
 	whereClause := ""
 	args := []interface{}{}
 	argCount := 1
 
+	if identitySource, ok := filters["identity_source"]; ok && identitySource != "" {
+		whereClause += fmt.Sprintf(" AND identity_source = $%d", argCount)
+		args = append(args, identitySource)
+		argCount++
+	}
+
+	if policyNamespace, ok := filters["policy_namespace"]; ok && policyNamespace != "" {
+		whereClause += fmt.Sprintf(" AND policy_namespace = $%d", argCount)
+		args = append(args, policyNamespace)
+		argCount++
+	}
+
 	if gitlabProject, ok := filters["gitlab_project"]; ok && gitlabProject != "" {
 		whereClause += fmt.Sprintf(" AND gitlab_project = $%d", argCount)
 		args = append(args, gitlabProject)
@@ -137,7 +187,7 @@ func (db *DB) GetAccessLogs(limit, offset int, filters map[string]string) ([]Acc
 	// Get total count
 	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM access_logs %s", whereClause)
 	var total int
-	err := db.conn.QueryRow(countQuery, args...).Scan(&total)
+	err := db.conn.QueryRowContext(ctx, countQuery, args...).Scan(&total)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to count access logs: %w", err)
 	}
@@ -145,15 +195,15 @@ func (db *DB) GetAccessLogs(limit, offset int, filters map[string]string) ([]Acc
 	// Get paginated results
 	args = append(args, limit, offset)
 	query := fmt.Sprintf(`
-		SELECT id, timestamp, gitlab_project, harbor_project, permission, 
-		       robot_id, robot_name, expires_at, pipeline_id, job_id, status, error_message
+		SELECT id, timestamp, identity_source, policy_namespace, gitlab_project, harbor_project, permission, 
+		       robot_id, robot_name, expires_at, ttl_minutes, pipeline_id, job_id, robot_scope, registry, status, error_message
 		FROM access_logs
 		%s
 		ORDER BY timestamp DESC
 		LIMIT $%d OFFSET $%d
 	`, whereClause, argCount, argCount+1)
 
-	rows, err := db.conn.Query(query, args...)
+	rows, err := db.conn.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to query access logs: %w", err)
 	}
@@ -165,14 +215,19 @@ func (db *DB) GetAccessLogs(limit, offset int, filters map[string]string) ([]Acc
 		err := rows.Scan(
 			&log.ID,
 			&log.Timestamp,
+			&log.IdentitySource,
+			&log.PolicyNamespace,
 			&log.GitLabProject,
 			&log.HarborProject,
 			&log.Permission,
 			&log.RobotID,
 			&log.RobotName,
 			&log.ExpiresAt,
+			&log.TTLMinutes,
 			&log.PipelineID,
 			&log.JobID,
+			&log.RobotScope,
+			&log.Registry,
 			&log.Status,
 			&log.ErrorMessage,
 		)
@@ -189,15 +244,72 @@ func (db *DB) GetAccessLogs(limit, offset int, filters map[string]string) ([]Acc
 	return logs, total, nil
 }
 
+// policyColumns lists the policy_rules columns read by scanPolicy
+const policyColumns = `id, effect, policy_namespace, gitlab_project, harbor_projects, allowed_permissions, conditions,
+	max_ttl_minutes, default_ttl_minutes, on_replay, robot_scope, registry, created_at, updated_at`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPolicy scans a policy_rules row selected with policyColumns
+func scanPolicy(row rowScanner) (PolicyRule, error) {
+	var policy PolicyRule
+	var conditionsJSON []byte
+	err := row.Scan(
+		&policy.ID,
+		&policy.Effect,
+		&policy.PolicyNamespace,
+		&policy.GitLabProject,
+		pq.Array(&policy.HarborProjects),
+		pq.Array(&policy.AllowedPermissions),
+		&conditionsJSON,
+		&policy.MaxTTLMinutes,
+		&policy.DefaultTTLMinutes,
+		&policy.OnReplay,
+		&policy.RobotScope,
+		&policy.Registry,
+		&policy.CreatedAt,
+		&policy.UpdatedAt,
+	)
+	if err != nil {
+		return policy, err
+	}
+
+	if len(conditionsJSON) > 0 {
+		if err := json.Unmarshal(conditionsJSON, &policy.Conditions); err != nil {
+			return policy, fmt.Errorf("failed to decode policy conditions: %w", err)
+		}
+	}
+
+	return policy, nil
+}
+
+// marshalConditions encodes policy conditions for the JSONB conditions column
+func marshalConditions(conditions map[string]string) (string, error) {
+	if conditions == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(conditions)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode policy conditions: %w", err)
+	}
+	return string(data), nil
+}
+
 // GetPolicies retrieves all policy rules
-func (db *DB) GetPolicies() ([]PolicyRule, error) {
-	query := `
-		SELECT id, gitlab_project, harbor_projects, allowed_permissions, created_at, updated_at
+func (db *DB) GetPolicies(ctx context.Context) ([]PolicyRule, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM policy_rules
-		ORDER BY gitlab_project
-	`
+		ORDER BY policy_namespace, gitlab_project, id
+	`, policyColumns)
 
-	rows, err := db.conn.Query(query)
+	rows, err := db.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query policies: %w", err)
 	}
@@ -205,15 +317,7 @@ func (db *DB) GetPolicies() ([]PolicyRule, error) {
 
 	var policies []PolicyRule
 	for rows.Next() {
-		var policy PolicyRule
-		err := rows.Scan(
-			&policy.ID,
-			&policy.GitLabProject,
-			&policy.HarborProjects,
-			&policy.AllowedPermissions,
-			&policy.CreatedAt,
-			&policy.UpdatedAt,
-		)
+		policy, err := scanPolicy(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan policy: %w", err)
 		}
@@ -228,18 +332,43 @@ func (db *DB) GetPolicies() ([]PolicyRule, error) {
 }
 
 // CreatePolicy creates a new policy rule
-func (db *DB) CreatePolicy(policy *PolicyRule) error {
+func (db *DB) CreatePolicy(ctx context.Context, policy *PolicyRule) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	conditions, err := marshalConditions(policy.Conditions)
+	if err != nil {
+		return err
+	}
+
+	if policy.Effect == "" {
+		policy.Effect = "allow"
+	}
+	if policy.AllowedPermissions == nil {
+		policy.AllowedPermissions = []string{}
+	}
+
 	query := `
-		INSERT INTO policy_rules (gitlab_project, harbor_projects, allowed_permissions)
-		VALUES ($1, $2, $3)
+		INSERT INTO policy_rules (effect, gitlab_project, harbor_projects, allowed_permissions, conditions,
+		                          max_ttl_minutes, default_ttl_minutes, policy_namespace, on_replay, robot_scope, registry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		RETURNING id, created_at, updated_at
 	`
 
-	err := db.conn.QueryRow(
+	err = db.conn.QueryRowContext(
+		ctx,
 		query,
+		policy.Effect,
 		policy.GitLabProject,
-		policy.HarborProjects,
-		policy.AllowedPermissions,
+		pq.Array(policy.HarborProjects),
+		pq.Array(policy.AllowedPermissions),
+		conditions,
+		policy.MaxTTLMinutes,
+		policy.DefaultTTLMinutes,
+		policy.PolicyNamespace,
+		policy.OnReplay,
+		policy.RobotScope,
+		policy.Registry,
 	).Scan(&policy.ID, &policy.CreatedAt, &policy.UpdatedAt)
 
 	if err != nil {
@@ -250,21 +379,47 @@ func (db *DB) CreatePolicy(policy *PolicyRule) error {
 }
 
 // UpdatePolicy updates an existing policy rule
-func (db *DB) UpdatePolicy(policy *PolicyRule) error {
+func (db *DB) UpdatePolicy(ctx context.Context, policy *PolicyRule) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	conditions, err := marshalConditions(policy.Conditions)
+	if err != nil {
+		return err
+	}
+
+	if policy.Effect == "" {
+		policy.Effect = "allow"
+	}
+	if policy.AllowedPermissions == nil {
+		policy.AllowedPermissions = []string{}
+	}
+
 	query := `
 		UPDATE policy_rules
-		SET gitlab_project = $1, harbor_projects = $2, allowed_permissions = $3, updated_at = NOW()
-		WHERE id = $4
-		RETURNING updated_at
+		SET effect = $1, gitlab_project = $2, harbor_projects = $3, allowed_permissions = $4, conditions = $5,
+		    max_ttl_minutes = $6, default_ttl_minutes = $7, policy_namespace = $8, on_replay = $9,
+		    robot_scope = $10, registry = $11, updated_at = NOW()
+		WHERE id = $12
+		RETURNING created_at, updated_at
 	`
 
-	err := db.conn.QueryRow(
+	err = db.conn.QueryRowContext(
+		ctx,
 		query,
+		policy.Effect,
 		policy.GitLabProject,
-		policy.HarborProjects,
-		policy.AllowedPermissions,
+		pq.Array(policy.HarborProjects),
+		pq.Array(policy.AllowedPermissions),
+		conditions,
+		policy.MaxTTLMinutes,
+		policy.DefaultTTLMinutes,
+		policy.PolicyNamespace,
+		policy.OnReplay,
+		policy.RobotScope,
+		policy.Registry,
 		policy.ID,
-	).Scan(&policy.UpdatedAt)
+	).Scan(&policy.CreatedAt, &policy.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return fmt.Errorf("policy not found")
@@ -277,10 +432,13 @@ func (db *DB) UpdatePolicy(policy *PolicyRule) error {
 }
 
 // DeletePolicy deletes a policy rule
-func (db *DB) DeletePolicy(id int64) error {
+func (db *DB) DeletePolicy(ctx context.Context, id int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
 	query := `DELETE FROM policy_rules WHERE id = $1`
 
-	result, err := db.conn.Exec(query, id)
+	result, err := db.conn.ExecContext(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete policy: %w", err)
 	}
@@ -297,30 +455,362 @@ func (db *DB) DeletePolicy(id int64) error {
 	return nil
 }
 
-// GetPolicyByGitLabProject retrieves a policy by GitLab project
-func (db *DB) GetPolicyByGitLabProject(gitlabProject string) (*PolicyRule, error) {
-	query := `
-		SELECT id, gitlab_project, harbor_projects, allowed_permissions, created_at, updated_at
+// GetPoliciesByGitLabProject retrieves every policy rule of a policy namespace that may apply
+// to a GitLab project: rules for exactly that path plus all pattern rules. Callers must match
+// patterns themselves.
+func (db *DB) GetPoliciesByGitLabProject(ctx context.Context, policyNamespace, gitlabProject string) ([]PolicyRule, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM policy_rules
-		WHERE gitlab_project = $1
+		WHERE policy_namespace = $1 AND (gitlab_project = $2 OR gitlab_project ~ '[*?\[]')
+		ORDER BY id
+	`, policyColumns)
+
+	rows, err := db.conn.QueryContext(ctx, query, policyNamespace, gitlabProject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []PolicyRule
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan policy: %w", err)
+		}
+		policies = append(policies, policy)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating policies: %w", err)
+	}
+
+	return policies, nil
+}
+
+// IssuedRobot represents a robot account issued by the broker that has not been deleted yet
+type IssuedRobot struct {
+	RobotID         int64
+	RobotName       string
+	IdentitySource  string
+	PolicyNamespace string
+	GitLabProject   string
+	HarborProject   string
+	Permission      string
+	PipelineID      string
+	JobID           string
+	RobotScope      string
+	Registry        string
+	ExpiresAt       time.Time
+}
+
+// GetIssuedRobots retrieves all issued robot accounts without a matching deletion or revocation entry.
+// Pool robots are leased rather than issued and are never deleted, so they are left out.
+func (db *DB) GetIssuedRobots(ctx context.Context) ([]IssuedRobot, error) {
+	return db.queryIssuedRobots(ctx, "")
+}
+
+// GetLiveJobRobots retrieves the unexpired robot accounts issued to a CI job in a
+// registry that have not been deleted yet. Unlike GetIssuedRobots, it only reads
+// the job's rows through an index, so it is cheap enough for every /token request.
+func (db *DB) GetLiveJobRobots(ctx context.Context, registry, policyNamespace, jobID string) ([]IssuedRobot, error) {
+	return db.queryIssuedRobots(ctx, "AND a.registry = $1 AND a.policy_namespace = $2 AND a.job_id = $3 AND a.expires_at > $4",
+		registry, policyNamespace, jobID, time.Now())
+}
+
+// GetLivePipelineRobots retrieves the unexpired robot accounts issued to any job
+// of a CI pipeline in a registry that have not been deleted yet
+func (db *DB) GetLivePipelineRobots(ctx context.Context, registry, policyNamespace, pipelineID string) ([]IssuedRobot, error) {
+	return db.queryIssuedRobots(ctx, "AND a.registry = $1 AND a.policy_namespace = $2 AND a.pipeline_id = $3 AND a.expires_at > $4",
+		registry, policyNamespace, pipelineID, time.Now())
+}
+
+// queryIssuedRobots retrieves issued robots that have not been deleted yet and
+// match the additional conditions
+func (db *DB) queryIssuedRobots(ctx context.Context, conditions string, args ...interface{}) ([]IssuedRobot, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT a.robot_id, COALESCE(a.robot_name, ''), a.identity_source, a.policy_namespace, a.gitlab_project, a.harbor_project, a.permission,
+		       COALESCE(a.pipeline_id, ''), COALESCE(a.job_id, ''), a.robot_scope, a.registry, a.expires_at
+		FROM access_logs a
+		WHERE a.status = 'success'
+		  AND a.robot_scope <> 'pool'
+		  AND a.robot_id IS NOT NULL
+		  AND a.expires_at IS NOT NULL
+		  ` + conditions + `
+		  AND NOT EXISTS (
+		      SELECT 1 FROM access_logs d
+		      WHERE d.robot_id = a.robot_id AND d.registry = a.registry AND d.status IN ('deleted', 'revoked')
+		  )
+		ORDER BY a.id
 	`
 
-	var policy PolicyRule
-	err := db.conn.QueryRow(query, gitlabProject).Scan(
-		&policy.ID,
-		&policy.GitLabProject,
-		&policy.HarborProjects,
-		&policy.AllowedPermissions,
-		&policy.CreatedAt,
-		&policy.UpdatedAt,
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query issued robots: %w", err)
+	}
+	defer rows.Close()
+
+	var robots []IssuedRobot
+	for rows.Next() {
+		var robot IssuedRobot
+		err := rows.Scan(
+			&robot.RobotID,
+			&robot.RobotName,
+			&robot.IdentitySource,
+			&robot.PolicyNamespace,
+			&robot.GitLabProject,
+			&robot.HarborProject,
+			&robot.Permission,
+			&robot.PipelineID,
+			&robot.JobID,
+			&robot.RobotScope,
+			&robot.Registry,
+			&robot.ExpiresAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan issued robot: %w", err)
+		}
+		robots = append(robots, robot)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating issued robots: %w", err)
+	}
+
+	return robots, nil
+}
+
+// PermissionProfile represents a named set of Harbor access actions
+type PermissionProfile struct {
+	ID          int64           `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Access      []harbor.Access `json:"access"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// profileColumns lists the permission_profiles columns read by scanPermissionProfile
+const profileColumns = `id, name, description, access, created_at, updated_at`
+
+// scanPermissionProfile scans a permission_profiles row selected with profileColumns
+func scanPermissionProfile(row rowScanner) (PermissionProfile, error) {
+	var profile PermissionProfile
+	var accessJSON []byte
+	err := row.Scan(
+		&profile.ID,
+		&profile.Name,
+		&profile.Description,
+		&accessJSON,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
 	)
+	if err != nil {
+		return profile, err
+	}
+
+	if err := json.Unmarshal(accessJSON, &profile.Access); err != nil {
+		return profile, fmt.Errorf("failed to decode profile access: %w", err)
+	}
+
+	return profile, nil
+}
+
+// GetPermissionProfiles retrieves all permission profiles
+func (db *DB) GetPermissionProfiles(ctx context.Context) ([]PermissionProfile, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM permission_profiles
+		ORDER BY name
+	`, profileColumns)
+
+	rows, err := db.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permission profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []PermissionProfile
+	for rows.Next() {
+		profile, err := scanPermissionProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan permission profile: %w", err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating permission profiles: %w", err)
+	}
+
+	return profiles, nil
+}
+
+// GetPermissionProfileByName retrieves a permission profile by name
+func (db *DB) GetPermissionProfileByName(ctx context.Context, name string) (*PermissionProfile, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM permission_profiles
+		WHERE name = $1
+	`, profileColumns)
+
+	profile, err := scanPermissionProfile(db.conn.QueryRowContext(ctx, query, name))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get policy: %w", err)
+		return nil, fmt.Errorf("failed to get permission profile: %w", err)
+	}
+
+	return &profile, nil
+}
+
+// CreatePermissionProfile creates a new permission profile
+func (db *DB) CreatePermissionProfile(ctx context.Context, profile *PermissionProfile) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	access, err := json.Marshal(profile.Access)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile access: %w", err)
+	}
+
+	query := `
+		INSERT INTO permission_profiles (name, description, access)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`
+
+	err = db.conn.QueryRowContext(
+		ctx,
+		query,
+		profile.Name,
+		profile.Description,
+		string(access),
+	).Scan(&profile.ID, &profile.CreatedAt, &profile.UpdatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to create permission profile: %w", err)
+	}
+
+	return nil
+}
+
+// UpdatePermissionProfile updates an existing permission profile
+func (db *DB) UpdatePermissionProfile(ctx context.Context, profile *PermissionProfile) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	access, err := json.Marshal(profile.Access)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile access: %w", err)
+	}
+
+	query := `
+		UPDATE permission_profiles
+		SET name = $1, description = $2, access = $3, updated_at = NOW()
+		WHERE id = $4
+		RETURNING created_at, updated_at
+	`
+
+	err = db.conn.QueryRowContext(
+		ctx,
+		query,
+		profile.Name,
+		profile.Description,
+		string(access),
+		profile.ID,
+	).Scan(&profile.CreatedAt, &profile.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("permission profile not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update permission profile: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePermissionProfile deletes a permission profile
+func (db *DB) DeletePermissionProfile(ctx context.Context, id int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM permission_profiles WHERE id = $1`
+
+	result, err := db.conn.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete permission profile: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("permission profile not found")
+	}
+
+	return nil
+}
+
+// MarkTokenUsed records a CI token ID and reports whether it was already recorded
+func (db *DB) MarkTokenUsed(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO used_tokens (token_id, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (token_id) DO NOTHING
+	`
+
+	result, err := db.conn.ExecContext(ctx, query, tokenID, expiresAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record used token: %w", err)
 	}
 
-	return &policy, nil
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected == 0, nil
+}
+
+// ForgetToken removes a recorded CI token ID
+func (db *DB) ForgetToken(ctx context.Context, tokenID string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM used_tokens WHERE token_id = $1`, tokenID); err != nil {
+		return fmt.Errorf("failed to delete used token: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredTokens removes recorded CI token IDs that expired before now
+func (db *DB) DeleteExpiredTokens(ctx context.Context, now time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM used_tokens WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("failed to delete expired used tokens: %w", err)
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package database
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/policy"
 )
 
@@ -14,20 +17,30 @@ func NewPolicyStoreAdapter(db *DB) *PolicyStoreAdapter {
 	return &PolicyStoreAdapter{db: db}
 }
 
-// GetPolicyByGitLabProject retrieves a policy by GitLab project
-func (p *PolicyStoreAdapter) GetPolicyByGitLabProject(gitlabProject string) (policy.PolicyRule, error) {
-	dbPolicy, err := p.db.GetPolicyByGitLabProject(gitlabProject)
+// GetPoliciesByGitLabProject retrieves every policy rule of a policy namespace that may apply to a GitLab project
+func (p *PolicyStoreAdapter) GetPoliciesByGitLabProject(ctx context.Context, policyNamespace, gitlabProject string) ([]policy.PolicyRule, error) {
+	dbPolicies, err := p.db.GetPoliciesByGitLabProject(ctx, policyNamespace, gitlabProject)
 	if err != nil {
-		return policy.PolicyRule{}, err
+		return nil, err
 	}
 
-	if dbPolicy == nil {
-		return policy.PolicyRule{}, nil
+	rules := make([]policy.PolicyRule, 0, len(dbPolicies))
+	for _, dbPolicy := range dbPolicies {
+		rules = append(rules, policy.PolicyRule{
+			Name:               fmt.Sprintf("policy #%d", dbPolicy.ID),
+			Effect:             dbPolicy.Effect,
+			PolicyNamespace:    dbPolicy.PolicyNamespace,
+			GitLabProject:      dbPolicy.GitLabProject,
+			HarborProjects:     dbPolicy.HarborProjects,
+			AllowedPermissions: dbPolicy.AllowedPermissions,
+			Conditions:         dbPolicy.Conditions,
+			MaxTTLMinutes:      dbPolicy.MaxTTLMinutes,
+			DefaultTTLMinutes:  dbPolicy.DefaultTTLMinutes,
+			OnReplay:           dbPolicy.OnReplay,
+			RobotScope:         dbPolicy.RobotScope,
+			Registry:           dbPolicy.Registry,
+		})
 	}
 
-	return policy.PolicyRule{
-		GitLabProject:      dbPolicy.GitLabProject,
-		HarborProjects:     dbPolicy.HarborProjects,
-		AllowedPermissions: dbPolicy.AllowedPermissions,
-	}, nil
+	return rules, nil
 }
@@ -0,0 +1,31 @@
+package database
+
+import (
+	"context"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+)
+
+// ProfileStoreAdapter adapts DB to policy.ProfileStore interface
+type ProfileStoreAdapter struct {
+	db *DB
+}
+
+// NewProfileStoreAdapter creates a new ProfileStoreAdapter
+func NewProfileStoreAdapter(db *DB) *ProfileStoreAdapter {
+	return &ProfileStoreAdapter{db: db}
+}
+
+// GetPermissionProfile retrieves the access list of a permission profile by name
+func (p *ProfileStoreAdapter) GetPermissionProfile(ctx context.Context, name string) ([]harbor.Access, bool, error) {
+	profile, err := p.db.GetPermissionProfileByName(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if profile == nil {
+		return nil, false, nil
+	}
+
+	return profile.Access, true, nil
+}
@@ -0,0 +1,31 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// ReplayStoreAdapter adapts DB to replay.Store interface
+type ReplayStoreAdapter struct {
+	db *DB
+}
+
+// NewReplayStoreAdapter creates a new ReplayStoreAdapter
+func NewReplayStoreAdapter(db *DB) *ReplayStoreAdapter {
+	return &ReplayStoreAdapter{db: db}
+}
+
+// MarkTokenUsed records a token ID and reports whether it was already recorded
+func (r *ReplayStoreAdapter) MarkTokenUsed(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	return r.db.MarkTokenUsed(ctx, tokenID, expiresAt)
+}
+
+// ForgetToken removes a recorded token ID
+func (r *ReplayStoreAdapter) ForgetToken(ctx context.Context, tokenID string) error {
+	return r.db.ForgetToken(ctx, tokenID)
+}
+
+// DeleteExpiredTokens removes token IDs that expired before now
+func (r *ReplayStoreAdapter) DeleteExpiredTokens(ctx context.Context, now time.Time) error {
+	return r.db.DeleteExpiredTokens(ctx, now)
+}
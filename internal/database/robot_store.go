@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/reaper"
+)
+
+// RobotStoreAdapter adapts DB to reaper.RobotStore interface
+type RobotStoreAdapter struct {
+	db *DB
+}
+
+// NewRobotStoreAdapter creates a new RobotStoreAdapter
+func NewRobotStoreAdapter(db *DB) *RobotStoreAdapter {
+	return &RobotStoreAdapter{db: db}
+}
+
+// ListIssuedRobots retrieves all issued robot accounts that have not been deleted yet
+func (r *RobotStoreAdapter) ListIssuedRobots(ctx context.Context) ([]reaper.TrackedRobot, error) {
+	dbRobots, err := r.db.GetIssuedRobots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mergeIssuedRobots(dbRobots), nil
+}
+
+// ListLiveJobRobots retrieves the unexpired robots issued to a CI job in a registry
+func (r *RobotStoreAdapter) ListLiveJobRobots(ctx context.Context, registry, policyNamespace, jobID string) ([]reaper.TrackedRobot, error) {
+	dbRobots, err := r.db.GetLiveJobRobots(ctx, registry, policyNamespace, jobID)
+	if err != nil {
+		return nil, err
+	}
+	return mergeIssuedRobots(dbRobots), nil
+}
+
+// ListLivePipelineRobots retrieves the unexpired robots issued to a CI pipeline in a registry
+func (r *RobotStoreAdapter) ListLivePipelineRobots(ctx context.Context, registry, policyNamespace, pipelineID string) ([]reaper.TrackedRobot, error) {
+	dbRobots, err := r.db.GetLivePipelineRobots(ctx, registry, policyNamespace, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	return mergeIssuedRobots(dbRobots), nil
+}
+
+// mergeIssuedRobots merges the audit rows of each robot into one tracked robot.
+// A robot covering several projects has one audit row per project; the rows are
+// merged into one robot with comma-separated projects and permissions. Shared
+// pipeline robots have rows for every job that got them and expire with the last.
+func mergeIssuedRobots(dbRobots []IssuedRobot) []reaper.TrackedRobot {
+	robots := make([]reaper.TrackedRobot, 0, len(dbRobots))
+	type robotKey struct {
+		registry string
+		id       int64
+	}
+	index := make(map[robotKey]int, len(dbRobots))
+	first := make(map[robotKey]IssuedRobot, len(dbRobots))
+	for _, dbRobot := range dbRobots {
+		key := robotKey{registry: dbRobot.Registry, id: dbRobot.RobotID}
+		if i, ok := index[key]; ok {
+			// Rows written for the same issuance name further projects
+			if dbRobot.JobID == first[key].JobID && dbRobot.ExpiresAt.Equal(first[key].ExpiresAt) {
+				robots[i].HarborProject += "," + dbRobot.HarborProject
+				robots[i].Permission += "," + dbRobot.Permission
+			} else if dbRobot.ExpiresAt.After(robots[i].ExpiresAt) {
+				robots[i].ExpiresAt = dbRobot.ExpiresAt
+			}
+			continue
+		}
+		index[key] = len(robots)
+		first[key] = dbRobot
+		robots = append(robots, reaper.TrackedRobot{
+			Registry:        dbRobot.Registry,
+			ID:              dbRobot.RobotID,
+			Name:            dbRobot.RobotName,
+			IdentitySource:  dbRobot.IdentitySource,
+			PolicyNamespace: dbRobot.PolicyNamespace,
+			GitLabProject:   dbRobot.GitLabProject,
+			HarborProject:   dbRobot.HarborProject,
+			Permission:      dbRobot.Permission,
+			PipelineID:      dbRobot.PipelineID,
+			JobID:           dbRobot.JobID,
+			RobotScope:      dbRobot.RobotScope,
+			ExpiresAt:       dbRobot.ExpiresAt,
+		})
+	}
+
+	return robots
+}
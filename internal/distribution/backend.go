@@ -0,0 +1,215 @@
+package distribution
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+)
+
+// credential is a username/password pair issued for a Distribution registry
+type credential struct {
+	id         int64
+	username   string
+	secretHash [sha256.Size]byte
+	grants     []harbor.ProjectGrant
+	expiresAt  time.Time
+}
+
+// Backend acts as the token-auth service of a CNCF Distribution registry.
+//
+// Distribution has no accounts of its own. The broker hands out a username and
+// password per CI job instead; the docker client exchanges them at the broker's
+// token endpoint for a bearer token that is scoped to the granted repositories
+// and signed with the broker's key, which the registry trusts.
+//
+// Credentials are only held in memory, so they do not survive a restart and
+// every broker instance only accepts the credentials it issued.
+type Backend struct {
+	name     string
+	url      string
+	hostname string
+	signer   *Signer
+	client   *http.Client
+
+	mu          sync.Mutex
+	credentials map[string]*credential // by username
+}
+
+// NewBackend creates a backend for the registry at url. Tokens are signed by
+// signer and only accepted by registries with its service and issuer.
+func NewBackend(name, registryURL string, signer *Signer) (*Backend, error) {
+	parsed, err := url.Parse(registryURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid registry URL '%s'", registryURL)
+	}
+
+	return &Backend{
+		name:     name,
+		url:      registryURL,
+		hostname: parsed.Host,
+		signer:   signer,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		credentials: make(map[string]*credential),
+	}, nil
+}
+
+// Name returns the registry name used in policies
+func (b *Backend) Name() string {
+	return b.name
+}
+
+// Hostname returns the registry host that docker clients log in to
+func (b *Backend) Hostname() string {
+	return b.hostname
+}
+
+// Service returns the service name the registry expects in token requests
+func (b *Backend) Service() string {
+	return b.signer.service
+}
+
+// IssueCredential creates a username and password with the access of every grant
+func (b *Backend) IssueCredential(ctx context.Context, name string, grants []harbor.ProjectGrant, ttlMinutes int) (*harbor.RobotAccount, error) {
+	secret, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(time.Duration(ttlMinutes) * time.Minute)
+	cred := &credential{
+		id:         mrand.Int64N(1 << 53),
+		username:   name,
+		secretHash: sha256.Sum256([]byte(secret)),
+		grants:     grants,
+		expiresAt:  expiresAt,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune(time.Now())
+	if _, ok := b.credentials[name]; ok {
+		return nil, fmt.Errorf("credential '%s' already exists", name)
+	}
+	b.credentials[name] = cred
+
+	return &harbor.RobotAccount{
+		ID:         cred.id,
+		Name:       name,
+		Secret:     secret,
+		ExpiresAt:  expiresAt,
+		ValidUntil: expiresAt,
+	}, nil
+}
+
+// RefreshRobotSecret replaces the password of an issued credential
+func (b *Backend) RefreshRobotSecret(ctx context.Context, id int64) (string, error) {
+	secret, err := randomSecret()
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cred, ok := b.byID(id)
+	if !ok {
+		return "", harbor.ErrRobotNotFound
+	}
+	cred.secretHash = sha256.Sum256([]byte(secret))
+	return secret, nil
+}
+
+// RevokeCredential invalidates an issued credential; tokens already minted for it
+// stay valid until they expire, which is at most the configured token TTL
+func (b *Backend) RevokeCredential(ctx context.Context, id int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cred, ok := b.byID(id)
+	if !ok {
+		return harbor.ErrRobotNotFound
+	}
+	delete(b.credentials, cred.username)
+	return nil
+}
+
+// Health checks that the registry answers its API base endpoint. A registry
+// behind token auth answers 401, which counts as healthy.
+func (b *Backend) Health(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.url+"/v2/", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("registry API error (status %d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// authenticate returns the grants of an unexpired credential with the given username and password
+func (b *Backend) authenticate(username, password string) (*credential, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cred, ok := b.credentials[username]
+	if !ok || !cred.expiresAt.After(time.Now()) {
+		return nil, false
+	}
+	hash := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(hash[:], cred.secretHash[:]) != 1 {
+		return nil, false
+	}
+
+	copied := *cred
+	return &copied, true
+}
+
+// byID finds a credential by ID; the caller must hold b.mu
+func (b *Backend) byID(id int64) (*credential, bool) {
+	for _, cred := range b.credentials {
+		if cred.id == id {
+			return cred, true
+		}
+	}
+	return nil, false
+}
+
+// prune drops expired credentials; the caller must hold b.mu
+func (b *Backend) prune(now time.Time) {
+	for username, cred := range b.credentials {
+		if !cred.expiresAt.After(now) {
+			delete(b.credentials, username)
+		}
+	}
+}
+
+// randomSecret generates a password for a credential
+func randomSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,310 @@
+package distribution
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
+)
+
+// Signer mints registry bearer tokens for one Distribution registry
+type Signer struct {
+	issuer   string
+	service  string
+	tokenTTL time.Duration
+	key      crypto.Signer
+	method   jwt.SigningMethod
+	chain    []string // base64 DER certificates for the x5c header
+}
+
+// NewSigner loads the broker's signing key and certificate. The registry must
+// list the certificate in auth.token.rootcertbundle and use the same issuer
+// and service.
+func NewSigner(keyFile, certFile, issuer, service string, tokenTTL time.Duration) (*Signer, error) {
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var method jwt.SigningMethod
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		// The ES algorithm is tied to the key's curve
+		switch k.Curve.Params().BitSize {
+		case 256:
+			method = jwt.SigningMethodES256
+		case 384:
+			method = jwt.SigningMethodES384
+		case 521:
+			method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s (must be P-256, P-384 or P-521)", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T (must be RSA or ECDSA)", key)
+	}
+
+	chain, leaf, err := readCertificates(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(leaf.PublicKey, key.Public()) {
+		return nil, fmt.Errorf("certificate %s does not match signing key %s", certFile, keyFile)
+	}
+
+	return &Signer{
+		issuer:   issuer,
+		service:  service,
+		tokenTTL: tokenTTL,
+		key:      key,
+		method:   method,
+		chain:    chain,
+	}, nil
+}
+
+// accessEntry is a resource and the actions granted on it, as the registry expects it
+type accessEntry struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// sign mints a token for subject with the given access that expires at the
+// configured token TTL, or notAfter if that is earlier
+func (s *Signer) sign(subject string, access []accessEntry, notAfter time.Time) (string, time.Time, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.tokenTTL)
+	if notAfter.Before(expiresAt) {
+		expiresAt = notAfter
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+
+	// Older registries only accept a single audience string, not a list
+	token := jwt.NewWithClaims(s.method, jwt.MapClaims{
+		"iss":    s.issuer,
+		"sub":    subject,
+		"aud":    s.service,
+		"exp":    expiresAt.Unix(),
+		"nbf":    now.Unix(),
+		"iat":    now.Unix(),
+		"jti":    base64.RawURLEncoding.EncodeToString(id),
+		"access": access,
+	})
+	token.Header["x5c"] = s.chain
+
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signed, now, expiresAt, nil
+}
+
+// TokenServer implements the Docker registry token endpoint for the broker's
+// Distribution backends. The registry sends clients to it with auth.token.realm;
+// the service parameter selects the backend.
+type TokenServer struct {
+	backends map[string]*Backend // by service
+	logger   *logging.Logger
+}
+
+// TokenResponse is the body of a successful token request
+type TokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// NewTokenServer creates a token endpoint for the given backends
+func NewTokenServer(backends []*Backend, logger *logging.Logger) *TokenServer {
+	byService := make(map[string]*Backend, len(backends))
+	for _, backend := range backends {
+		byService[backend.Service()] = backend
+	}
+	return &TokenServer{
+		backends: byService,
+		logger:   logger,
+	}
+}
+
+// ServeHTTP handles GET token requests authenticated with a broker-issued credential
+func (t *TokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		t.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	backend, ok := t.backends[query.Get("service")]
+	if !ok {
+		t.respondError(w, http.StatusBadRequest, "unknown service")
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", backend.Service()))
+		t.respondError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	cred, ok := backend.authenticate(username, password)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", backend.Service()))
+		t.respondError(w, http.StatusUnauthorized, "invalid or expired credentials")
+		return
+	}
+
+	// Scopes may be repeated or space-separated
+	access := []accessEntry{}
+	for _, param := range query["scope"] {
+		for _, scope := range strings.Fields(param) {
+			if entry, ok := grantedAccess(scope, cred.grants); ok {
+				access = append(access, entry)
+			}
+		}
+	}
+
+	token, issuedAt, expiresAt, err := backend.signer.sign(cred.username, access, cred.expiresAt)
+	if err != nil {
+		t.logger.Error("Failed to sign registry token", err)
+		t.respondError(w, http.StatusInternalServerError, "failed to sign token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(expiresAt.Sub(issuedAt).Seconds()),
+		IssuedAt:    issuedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// grantedAccess returns the part of a requested scope, e.g.
+// "repository:team-x/app:pull,push", that the grants allow. A repository
+// belongs to the project named by its first path segment.
+func grantedAccess(scope string, grants []harbor.ProjectGrant) (accessEntry, bool) {
+	first := strings.Index(scope, ":")
+	last := strings.LastIndex(scope, ":")
+	if first < 0 || first == last {
+		return accessEntry{}, false
+	}
+	resourceType, name, requested := scope[:first], scope[first+1:last], strings.Split(scope[last+1:], ",")
+	if resourceType != "repository" {
+		return accessEntry{}, false
+	}
+
+	project, _, _ := strings.Cut(name, "/")
+	entry := accessEntry{Type: resourceType, Name: name}
+	for _, grant := range grants {
+		if grant.Project != project {
+			continue
+		}
+		for _, action := range requested {
+			for _, access := range grant.Access {
+				if access.Resource == "repository" && access.Action == action {
+					entry.Actions = append(entry.Actions, action)
+					break
+				}
+			}
+		}
+	}
+	if len(entry.Actions) == 0 {
+		return accessEntry{}, false
+	}
+	return entry, true
+}
+
+// respondError sends an error response in the registry's error format
+func (t *TokenServer) respondError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": "UNAUTHORIZED", "message": message}},
+	})
+}
+
+// readPrivateKey reads a PEM-encoded PKCS#8, PKCS#1 or SEC 1 private key
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM-encoded", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported signing key type %T", key)
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("failed to parse signing key %s", path)
+}
+
+// readCertificates reads a PEM certificate chain, leaf first
+func readCertificates(path string) ([]string, *x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+
+	var chain []string
+	var leaf *x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if leaf == nil {
+			leaf, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse certificate %s: %w", path, err)
+			}
+		}
+		chain = append(chain, base64.StdEncoding.EncodeToString(block.Bytes))
+	}
+	if leaf == nil {
+		return nil, nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return chain, leaf, nil
+}
+
+// publicKeysEqual reports whether two public keys are the same
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
@@ -1,25 +1,41 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"path"
 	"strconv"
 
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/database"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/pattern"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/policy"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/registry"
 )
 
 // APIHandler handles API requests for the UI
 type APIHandler struct {
-	db     *database.DB
-	logger *logging.Logger
+	db         *database.DB
+	profiles   *policy.Profiles
+	registries *registry.Set
+	namespaces map[string][]string // identity providers by policy namespace
+	logger     *logging.Logger
 }
 
-// NewAPIHandler creates a new API handler
-func NewAPIHandler(db *database.DB, logger *logging.Logger) *APIHandler {
+// NewAPIHandler creates a new API handler. Policy rules submitted via the API
+// may only name the given permission profiles, registries and policy
+// namespaces; namespaces maps each namespace to the identity providers of its sources.
+func NewAPIHandler(db *database.DB, profiles *policy.Profiles, registries *registry.Set, namespaces map[string][]string, logger *logging.Logger) *APIHandler {
 	return &APIHandler{
-		db:     db,
-		logger: logger,
+		db:         db,
+		profiles:   profiles,
+		registries: registries,
+		namespaces: namespaces,
+		logger:     logger,
 	}
 }
 
@@ -54,6 +70,12 @@ func (h *APIHandler) HandleGetAccessLogs(w http.ResponseWriter, r *http.Request)
 
 	// Build filters
 	filters := make(map[string]string)
+	if identitySource := query.Get("identity_source"); identitySource != "" {
+		filters["identity_source"] = identitySource
+	}
+	if policyNamespace := query.Get("policy_namespace"); policyNamespace != "" {
+		filters["policy_namespace"] = policyNamespace
+	}
 	if gitlabProject := query.Get("gitlab_project"); gitlabProject != "" {
 		filters["gitlab_project"] = gitlabProject
 	}
@@ -65,7 +87,7 @@ func (h *APIHandler) HandleGetAccessLogs(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Get logs from database
-	logs, total, err := h.db.GetAccessLogs(limit, offset, filters)
+	logs, total, err := h.db.GetAccessLogs(r.Context(), limit, offset, filters)
 	if err != nil {
 		h.logger.Error("Failed to get access logs", err)
 		h.respondError(w, http.StatusInternalServerError, "failed to retrieve access logs")
@@ -89,7 +111,7 @@ func (h *APIHandler) HandleGetPolicies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	policies, err := h.db.GetPolicies()
+	policies, err := h.db.GetPolicies(r.Context())
 	if err != nil {
 		h.logger.Error("Failed to get policies", err)
 		h.respondError(w, http.StatusInternalServerError, "failed to retrieve policies")
@@ -113,20 +135,12 @@ func (h *APIHandler) HandleCreatePolicy(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Validate policy
-	if policy.GitLabProject == "" {
-		h.respondError(w, http.StatusBadRequest, "gitlab_project is required")
-		return
-	}
-	if len(policy.HarborProjects) == 0 {
-		h.respondError(w, http.StatusBadRequest, "harbor_projects must not be empty")
-		return
-	}
-	if len(policy.AllowedPermissions) == 0 {
-		h.respondError(w, http.StatusBadRequest, "allowed_permissions must not be empty")
+	if err := h.validatePolicy(r.Context(), &policy); err != nil {
+		h.respondInvalidPolicy(w, err)
 		return
 	}
 
-	if err := h.db.CreatePolicy(&policy); err != nil {
+	if err := h.db.CreatePolicy(r.Context(), &policy); err != nil {
 		h.logger.Error("Failed to create policy", err)
 		h.respondError(w, http.StatusInternalServerError, "failed to create policy")
 		return
@@ -142,17 +156,9 @@ func (h *APIHandler) HandleUpdatePolicy(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Extract ID from URL path and validate it's numeric
-	idStr := r.URL.Path[len("/api/policies/"):]
-	// Validate that idStr contains only digits to prevent path traversal
-	for _, ch := range idStr {
-		if ch < '0' || ch > '9' {
-			h.respondError(w, http.StatusBadRequest, "invalid policy ID")
-			return
-		}
-	}
-	id, err := strconv.ParseInt(idStr, 10, 64)
-	if err != nil || id <= 0 {
+	// Extract ID from URL path
+	id, ok := parsePathID(r.URL.Path, "/api/policies/")
+	if !ok {
 		h.respondError(w, http.StatusBadRequest, "invalid policy ID")
 		return
 	}
@@ -166,20 +172,12 @@ func (h *APIHandler) HandleUpdatePolicy(w http.ResponseWriter, r *http.Request)
 	policy.ID = id
 
 	// Validate policy
-	if policy.GitLabProject == "" {
-		h.respondError(w, http.StatusBadRequest, "gitlab_project is required")
-		return
-	}
-	if len(policy.HarborProjects) == 0 {
-		h.respondError(w, http.StatusBadRequest, "harbor_projects must not be empty")
-		return
-	}
-	if len(policy.AllowedPermissions) == 0 {
-		h.respondError(w, http.StatusBadRequest, "allowed_permissions must not be empty")
+	if err := h.validatePolicy(r.Context(), &policy); err != nil {
+		h.respondInvalidPolicy(w, err)
 		return
 	}
 
-	if err := h.db.UpdatePolicy(&policy); err != nil {
+	if err := h.db.UpdatePolicy(r.Context(), &policy); err != nil {
 		h.logger.Error("Failed to update policy", err)
 		if err.Error() == "policy not found" {
 			h.respondError(w, http.StatusNotFound, "policy not found")
@@ -199,22 +197,14 @@ func (h *APIHandler) HandleDeletePolicy(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Extract ID from URL path and validate it's numeric
-	idStr := r.URL.Path[len("/api/policies/"):]
-	// Validate that idStr contains only digits to prevent path traversal
-	for _, ch := range idStr {
-		if ch < '0' || ch > '9' {
-			h.respondError(w, http.StatusBadRequest, "invalid policy ID")
-			return
-		}
-	}
-	id, err := strconv.ParseInt(idStr, 10, 64)
-	if err != nil || id <= 0 {
+	// Extract ID from URL path
+	id, ok := parsePathID(r.URL.Path, "/api/policies/")
+	if !ok {
 		h.respondError(w, http.StatusBadRequest, "invalid policy ID")
 		return
 	}
 
-	if err := h.db.DeletePolicy(id); err != nil {
+	if err := h.db.DeletePolicy(r.Context(), id); err != nil {
 		h.logger.Error("Failed to delete policy", err)
 		if err.Error() == "policy not found" {
 			h.respondError(w, http.StatusNotFound, "policy not found")
@@ -227,6 +217,243 @@ func (h *APIHandler) HandleDeletePolicy(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandleGetPermissionProfiles handles GET /api/permission-profiles
+func (h *APIHandler) HandleGetPermissionProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	profiles, err := h.db.GetPermissionProfiles(r.Context())
+	if err != nil {
+		h.logger.Error("Failed to get permission profiles", err)
+		h.respondError(w, http.StatusInternalServerError, "failed to retrieve permission profiles")
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, profiles)
+}
+
+// HandleCreatePermissionProfile handles POST /api/permission-profiles
+func (h *APIHandler) HandleCreatePermissionProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var profile database.PermissionProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// Validate profile
+	if err := validatePermissionProfile(&profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.db.CreatePermissionProfile(r.Context(), &profile); err != nil {
+		h.logger.Error("Failed to create permission profile", err)
+		h.respondError(w, http.StatusInternalServerError, "failed to create permission profile")
+		return
+	}
+
+	h.respondJSON(w, http.StatusCreated, profile)
+}
+
+// HandleUpdatePermissionProfile handles PUT /api/permission-profiles/:id
+func (h *APIHandler) HandleUpdatePermissionProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Extract ID from URL path
+	id, ok := parsePathID(r.URL.Path, "/api/permission-profiles/")
+	if !ok {
+		h.respondError(w, http.StatusBadRequest, "invalid permission profile ID")
+		return
+	}
+
+	var profile database.PermissionProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	profile.ID = id
+
+	// Validate profile
+	if err := validatePermissionProfile(&profile); err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.db.UpdatePermissionProfile(r.Context(), &profile); err != nil {
+		h.logger.Error("Failed to update permission profile", err)
+		if err.Error() == "permission profile not found" {
+			h.respondError(w, http.StatusNotFound, "permission profile not found")
+		} else {
+			h.respondError(w, http.StatusInternalServerError, "failed to update permission profile")
+		}
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, profile)
+}
+
+// HandleDeletePermissionProfile handles DELETE /api/permission-profiles/:id
+func (h *APIHandler) HandleDeletePermissionProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Extract ID from URL path
+	id, ok := parsePathID(r.URL.Path, "/api/permission-profiles/")
+	if !ok {
+		h.respondError(w, http.StatusBadRequest, "invalid permission profile ID")
+		return
+	}
+
+	if err := h.db.DeletePermissionProfile(r.Context(), id); err != nil {
+		h.logger.Error("Failed to delete permission profile", err)
+		if err.Error() == "permission profile not found" {
+			h.respondError(w, http.StatusNotFound, "permission profile not found")
+		} else {
+			h.respondError(w, http.StatusInternalServerError, "failed to delete permission profile")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parsePathID extracts a positive numeric ID following prefix in a URL path
+func parsePathID(path, prefix string) (int64, bool) {
+	idStr := path[len(prefix):]
+	// Validate that idStr contains only digits to prevent path traversal
+	for _, ch := range idStr {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// validatePermissionProfile checks a permission profile submitted via the API
+func validatePermissionProfile(profile *database.PermissionProfile) error {
+	if profile.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if policy.IsBuiltinProfile(profile.Name) {
+		return fmt.Errorf("'%s' is a built-in profile and cannot be redefined", profile.Name)
+	}
+	if len(profile.Access) == 0 {
+		return fmt.Errorf("access must not be empty")
+	}
+	for i, access := range profile.Access {
+		if access.Resource == "" || access.Action == "" {
+			return fmt.Errorf("access[%d]: resource and action are required", i)
+		}
+	}
+	return nil
+}
+
+// profileLookupError reports that permission profiles could not be loaded
+// while validating a policy rule
+type profileLookupError struct {
+	err error
+}
+
+func (e *profileLookupError) Error() string {
+	return fmt.Sprintf("failed to resolve permission profile: %v", e.err)
+}
+
+func (e *profileLookupError) Unwrap() error {
+	return e.err
+}
+
+// respondInvalidPolicy answers a policy rule that failed validation with 400,
+// or with 500 if permission profiles could not be loaded
+func (h *APIHandler) respondInvalidPolicy(w http.ResponseWriter, err error) {
+	var lookupErr *profileLookupError
+	if errors.As(err, &lookupErr) {
+		h.logger.Error("Failed to resolve permission profile", lookupErr.err)
+		h.respondError(w, http.StatusInternalServerError, "failed to resolve permission profile")
+		return
+	}
+	h.respondError(w, http.StatusBadRequest, err.Error())
+}
+
+// validatePolicy checks a policy rule submitted via the API
+func (h *APIHandler) validatePolicy(ctx context.Context, rule *database.PolicyRule) error {
+	if rule.GitLabProject == "" {
+		return fmt.Errorf("gitlab_project is required")
+	}
+	providers, ok := h.namespaces[rule.PolicyNamespace]
+	if !ok {
+		return fmt.Errorf("policy_namespace '%s' does not belong to any identity source", rule.PolicyNamespace)
+	}
+	if err := pattern.ValidateProject(rule.GitLabProject); err != nil {
+		return err
+	}
+	if len(rule.HarborProjects) == 0 {
+		return fmt.Errorf("harbor_projects must not be empty")
+	}
+	for _, harborProject := range rule.HarborProjects {
+		if err := pattern.ValidateTemplate(harborProject); err != nil {
+			return err
+		}
+	}
+	if rule.Effect != "" && rule.Effect != policy.EffectAllow && rule.Effect != policy.EffectDeny {
+		return fmt.Errorf("effect must be 'allow' or 'deny'")
+	}
+	// Deny rules without permissions deny every permission
+	if len(rule.AllowedPermissions) == 0 && rule.Effect != policy.EffectDeny {
+		return fmt.Errorf("allowed_permissions must not be empty")
+	}
+	for _, permission := range rule.AllowedPermissions {
+		if err := h.profiles.ValidatePermission(ctx, permission); err != nil {
+			if errors.Is(err, policy.ErrUnknownPermission) {
+				return err
+			}
+			return &profileLookupError{err: err}
+		}
+	}
+	if rule.MaxTTLMinutes < 0 || rule.DefaultTTLMinutes < 0 {
+		return fmt.Errorf("TTL values must not be negative")
+	}
+	if rule.MaxTTLMinutes > 0 && rule.DefaultTTLMinutes > rule.MaxTTLMinutes {
+		return fmt.Errorf("default_ttl_minutes must not exceed max_ttl_minutes")
+	}
+	if rule.OnReplay != "" && rule.OnReplay != policy.ReplayReject && rule.OnReplay != policy.ReplayDeduplicate {
+		return fmt.Errorf("on_replay must be 'reject' or 'deduplicate'")
+	}
+	if rule.RobotScope != "" && rule.RobotScope != policy.RobotScopeJob && rule.RobotScope != policy.RobotScopePipeline {
+		return fmt.Errorf("robot_scope must be 'job' or 'pipeline'")
+	}
+	if _, ok := h.registries.Get(rule.Registry); !ok {
+		return fmt.Errorf("registry '%s' is not configured", rule.Registry)
+	}
+	for claim, value := range rule.Conditions {
+		for _, provider := range providers {
+			if !identity.IsConditionClaim(provider, claim) {
+				return fmt.Errorf("unsupported condition claim '%s' for provider %s", claim, provider)
+			}
+		}
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid condition pattern '%s' for claim '%s'", value, claim)
+		}
+	}
+	return nil
+}
+
 // respondJSON sends a JSON response
 func (h *APIHandler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+)
+
+// issuedCredential is the result of one credential issuance
+type issuedCredential struct {
+	robot      *harbor.RobotAccount
+	ttlMinutes int
+}
+
+// flightCall is an issuance in progress
+type flightCall struct {
+	done       chan struct{}
+	credential *issuedCredential
+	err        error
+}
+
+// flightGroup collapses concurrent issuances with the same key into one,
+// so duplicate requests of a job cause a single Harbor call
+type flightGroup struct {
+	serverCtx context.Context // cancelled on shutdown; shared calls run on it
+
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// newFlightGroup creates an empty flight group whose shared calls are
+// cancelled with serverCtx
+func newFlightGroup(serverCtx context.Context) *flightGroup {
+	return &flightGroup{
+		serverCtx: serverCtx,
+		calls:     make(map[string]*flightCall),
+	}
+}
+
+// do runs issue once for all concurrent callers with the same key and returns
+// its result to each of them. An empty key is never collapsed. Waiting callers
+// stop waiting when their context is done. The shared call runs on the server
+// context instead of the first caller's, so its disconnect does not fail the
+// others, while shutdown still cancels it; it keeps the first caller's deadline.
+func (g *flightGroup) do(ctx context.Context, key string, issue func(context.Context) (*issuedCredential, error)) (*issuedCredential, error) {
+	if key == "" {
+		return issue(ctx)
+	}
+
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.credential, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	callCtx, cancel := context.WithCancel(g.serverCtx)
+	if deadline, ok := ctx.Deadline(); ok {
+		callCtx, cancel = context.WithDeadline(g.serverCtx, deadline)
+	}
+	defer cancel()
+	call.credential, call.err = issue(callCtx)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+
+	return call.credential, call.err
+}
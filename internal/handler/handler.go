@@ -1,38 +1,95 @@
 package handler
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
-	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/jwt"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/policy"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/pool"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/reaper"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/registry"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/replay"
 )
 
 // Handler handles HTTP requests
 type Handler struct {
-	jwtValidator *jwt.Validator
-	policyEngine *policy.Engine
-	harborClient *harbor.Client
-	logger       *logging.Logger
-	robotTTL     int
+	authenticator *identity.Authenticator
+	policyEngine  *policy.Engine
+	profiles      *policy.Profiles
+	registries    *registry.Set
+	logger        *logging.Logger
+	reaper        *reaper.Reaper
+	replayGuard   *replay.Guard // nil when replay protection is disabled
+	robotPool     *pool.Pool    // nil when pool mode is disabled
+	issuance      *flightGroup
+	sharedSecrets *sharedSecrets
+	robotTTL      int
+	maxTTL        int // upper bound of every credential TTL in minutes; 0 for none
 }
 
-// TokenRequest represents the request body for /token endpoint
+// TokenRequest represents the request body for /token endpoint.
+// Either HarborProject and Permissions, or Projects must be set.
 type TokenRequest struct {
+	HarborProject string           `json:"harbor_project"`
+	Permissions   string           `json:"permissions"`
+	Projects      []ProjectRequest `json:"projects,omitempty"`
+	TTLMinutes    int              `json:"ttl_minutes,omitempty"` // optional, clamped by policy and JWT lifetime
+	Registry      string           `json:"registry,omitempty"`    // configured registry name; empty = harbor section
+}
+
+// ProjectRequest represents one Harbor project and permission in a /token request
+type ProjectRequest struct {
 	HarborProject string `json:"harbor_project"`
-	Permissions   string `json:"permissions"`
+	Permission    string `json:"permission"`
 }
 
 // TokenResponse represents the response for /token endpoint
 type TokenResponse struct {
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	ExpiresAt string `json:"expires_at"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	ExpiresAt  string `json:"expires_at"`
+	TTLMinutes int    `json:"ttl_minutes"`
+	Registry   string `json:"registry"` // host the credential is valid for, e.g. for docker login
+}
+
+// RevokeRequest represents the optional request body for /revoke endpoint
+type RevokeRequest struct {
+	Scope string `json:"scope"` // "job" (default) or "pipeline"
+}
+
+// RevokeResponse represents the response for /revoke endpoint
+type RevokeResponse struct {
+	Revoked []string `json:"revoked"`
+}
+
+// EvaluateRequest represents the request body for /api/policies/evaluate endpoint.
+// Either Token (a raw CI JWT, fully validated) or Claims must be set.
+type EvaluateRequest struct {
+	Token           string                 `json:"token"`
+	Claims          map[string]interface{} `json:"claims"`
+	PolicyNamespace string                 `json:"policy_namespace,omitempty"` // identity source of Claims; tokens carry their own
+	Registry        string                 `json:"registry,omitempty"`
+	HarborProject   string                 `json:"harbor_project"`
+	Permission      string                 `json:"permission"`
+}
+
+// ReadyResponse represents the response for /ready endpoint
+type ReadyResponse struct {
+	Status     string            `json:"status"`
+	Registries map[string]string `json:"registries"` // registry name -> "ok" or error
 }
 
 // ErrorResponse represents an error response
@@ -40,14 +97,23 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-// NewHandler creates a new HTTP handler
-func NewHandler(jwtValidator *jwt.Validator, policyEngine *policy.Engine, harborClient *harbor.Client, logger *logging.Logger, robotTTL int) *Handler {
+// NewHandler creates a new HTTP handler. Credential TTLs default to robotTTL
+// minutes and are capped at maxTTL minutes, unless maxTTL is 0. Cancelling
+// serverCtx stops issuances that outlive their request, e.g. on shutdown.
+func NewHandler(serverCtx context.Context, authenticator *identity.Authenticator, policyEngine *policy.Engine, profiles *policy.Profiles, registries *registry.Set, robotReaper *reaper.Reaper, robotPool *pool.Pool, replayGuard *replay.Guard, logger *logging.Logger, robotTTL, maxTTL int) *Handler {
 	return &Handler{
-		jwtValidator: jwtValidator,
-		policyEngine: policyEngine,
-		harborClient: harborClient,
-		logger:       logger,
-		robotTTL:     robotTTL,
+		authenticator: authenticator,
+		policyEngine:  policyEngine,
+		profiles:      profiles,
+		registries:    registries,
+		reaper:        robotReaper,
+		robotPool:     robotPool,
+		replayGuard:   replayGuard,
+		issuance:      newFlightGroup(serverCtx),
+		sharedSecrets: newSharedSecrets(),
+		logger:        logger,
+		robotTTL:      robotTTL,
+		maxTTL:        maxTTL,
 	}
 }
 
@@ -59,24 +125,12 @@ func (h *Handler) HandleToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract JWT from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		h.respondError(w, http.StatusUnauthorized, "missing authorization header")
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == authHeader {
-		h.respondError(w, http.StatusUnauthorized, "invalid authorization header format")
-		return
-	}
+	// Harbor and database calls stop when the client goes away or the server shuts down
+	ctx := r.Context()
 
-	// Validate JWT
-	claims, err := h.jwtValidator.ValidateToken(tokenString)
-	if err != nil {
-		h.logger.Error("JWT validation failed", err)
-		h.respondError(w, http.StatusUnauthorized, "invalid or expired token")
+	// Authenticate the CI job
+	workload, ok := h.authenticate(w, r)
+	if !ok {
 		return
 	}
 
@@ -88,52 +142,391 @@ func (h *Handler) HandleToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if req.HarborProject == "" {
-		h.respondError(w, http.StatusBadRequest, "harbor_project is required")
+	projects, err := req.projectRequests()
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if req.Permissions == "" {
-		h.respondError(w, http.StatusBadRequest, "permissions is required")
+	if req.TTLMinutes < 0 {
+		h.respondError(w, http.StatusBadRequest, "ttl_minutes must not be negative")
 		return
 	}
-
-	// Validate permission format
-	if err := policy.ValidatePermission(req.Permissions); err != nil {
-		h.respondError(w, http.StatusBadRequest, err.Error())
+	backend, ok := h.registries.Get(req.Registry)
+	if !ok {
+		h.respondError(w, http.StatusBadRequest, fmt.Sprintf("unknown registry '%s'", req.Registry))
 		return
 	}
 
-	// Check authorization policy
-	if err := h.policyEngine.AuthorizeRequest(claims.ProjectPath, req.HarborProject, req.Permissions); err != nil {
-		h.logger.AuditRequestDenied(claims.ProjectPath, req.HarborProject, req.Permissions, err.Error())
+	// Resolve permission profiles to Harbor access actions
+	grants := make([]harbor.ProjectGrant, 0, len(projects))
+	for _, project := range projects {
+		access, err := h.profiles.Resolve(ctx, project.Permission)
+		if errors.Is(err, policy.ErrUnknownPermission) {
+			h.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			h.logger.Error("Failed to resolve permission profile", err)
+			h.respondError(w, http.StatusInternalServerError, "failed to resolve permission profile")
+			return
+		}
+		grants = append(grants, harbor.ProjectGrant{Project: project.HarborProject, Access: access})
+	}
+
+	// Check authorization policy for every project in the requested registry; all must be allowed
+	rules := make([]*policy.PolicyRule, len(projects))
+	denials := make([]error, len(projects))
+	denied := false
+	for i, project := range projects {
+		rules[i], denials[i] = h.policyEngine.AuthorizeRequest(ctx, workload, req.Registry, project.HarborProject, project.Permission)
+		if denials[i] != nil {
+			denied = true
+		}
+	}
+	if denied {
+		for i, project := range projects {
+			reason := "not issued: another project in the same request was denied"
+			if denials[i] != nil {
+				reason = denials[i].Error()
+			}
+			h.logger.AuditRequestDenied(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, reason)
+		}
 		h.respondError(w, http.StatusForbidden, "access denied by policy")
 		return
 	}
 
-	// Generate robot account name
-	robotName := fmt.Sprintf("ci-temp-%s-%d", claims.JobID, time.Now().Unix())
+	// Determine the credential lifetime; the most restrictive rule wins
+	ttlMinutes := 0
+	for _, rule := range rules {
+		ruleTTL, err := h.effectiveTTL(rule, req.TTLMinutes, workload)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ttlMinutes == 0 || ruleTTL < ttlMinutes {
+			ttlMinutes = ruleTTL
+		}
+	}
 
-	// Create Harbor robot account
-	robot, err := h.harborClient.CreateRobotAccount(req.HarborProject, robotName, req.Permissions, h.robotTTL)
+	// Issue credentials idempotently per job, or per pipeline for shared robots;
+	// concurrent duplicates share one issuance. With replay protection, duplicates
+	// of the same request with the same token are collapsed before the replay
+	// check, so only a request repeated after the first one finished counts as replayed.
+	scope := robotScope(workload, rules)
+	issue := func(ctx context.Context) (*issuedCredential, error) {
+		return h.issuance.do(ctx, issuanceKey(workload, req.Registry, projects, scope), func(ctx context.Context) (*issuedCredential, error) {
+			if scope == policy.RobotScopePipeline {
+				return h.issueSharedCredential(ctx, workload, req.Registry, projects, grants, ttlMinutes)
+			}
+			return h.issueCredential(ctx, workload, req.Registry, projects, grants, ttlMinutes)
+		})
+	}
+	var issued *issuedCredential
+	if h.replayGuard != nil {
+		use := replayUse(workload, req.Registry, projects)
+		issued, err = h.issuance.do(ctx, replayKey(use), func(ctx context.Context) (*issuedCredential, error) {
+			if err := h.checkReplay(ctx, workload, use, projects, rules); err != nil {
+				return nil, err
+			}
+			issued, err := issue(ctx)
+			if err != nil {
+				// Allow the job to retry with the same token, even if this request was cancelled
+				if err := h.replayGuard.Forget(context.WithoutCancel(ctx), use); err != nil {
+					h.logger.Error("Failed to forget token ID", err)
+				}
+			}
+			return issued, err
+		})
+	} else {
+		issued, err = issue(ctx)
+	}
+	if errors.Is(err, errTokenReused) {
+		h.respondError(w, http.StatusConflict, "token has already been used")
+		return
+	}
+	var replayErr *replayError
+	if errors.As(err, &replayErr) {
+		h.logger.Error("Token replay check failed", replayErr.err)
+		h.respondError(w, http.StatusInternalServerError, replayErr.message)
+		return
+	}
 	if err != nil {
 		h.logger.Error("Failed to create robot account", err)
+		// Fail fast while Harbor is down, and tell the job when to try again
+		var circuitOpen *harbor.CircuitOpenError
+		if errors.As(err, &circuitOpen) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(circuitOpen.RetryAfter.Seconds()))))
+			h.respondError(w, http.StatusServiceUnavailable, "harbor is unavailable")
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			h.respondError(w, http.StatusGatewayTimeout, "timed out creating credentials")
+			return
+		}
 		h.respondError(w, http.StatusInternalServerError, "failed to create credentials")
 		return
 	}
-
-	// Log audit event
-	h.logger.AuditTokenIssued(claims.ProjectPath, req.HarborProject, req.Permissions, robot.ID, robot.Name, robot.ExpiresAt, claims.PipelineID, claims.JobID)
+	robot := issued.robot
 
 	// Return response
 	response := TokenResponse{
-		Username:  robot.Name,
-		Password:  robot.Secret,
-		ExpiresAt: robot.ExpiresAt.Format(time.RFC3339),
+		Username:   robot.Name,
+		Password:   robot.Secret,
+		ExpiresAt:  robot.ExpiresAt.Format(time.RFC3339),
+		TTLMinutes: issued.ttlMinutes,
+		Registry:   backend.Hostname(),
+	}
+
+	h.respondJSON(w, http.StatusOK, response)
+}
+
+// errTokenReused is returned when a replayed token is rejected
+var errTokenReused = errors.New("token has already been used")
+
+// replayError is a failure of the replay check, with the message for the client
+type replayError struct {
+	message string
+	err     error
+}
+
+func (e *replayError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *replayError) Unwrap() error {
+	return e.err
+}
+
+// replayUse identifies a request made with a token by the token ID and a digest
+// of the registry and the requested projects and permissions. A token may be
+// used once per distinct request, e.g. once per Harbor project or registry.
+// Tokens without an ID get an empty use, which is never tracked.
+func replayUse(workload *identity.Identity, registryName string, projects []ProjectRequest) string {
+	if workload.TokenID == "" {
+		return ""
+	}
+	harborProject, permission := joinProjects(projects)
+	sum := sha256.Sum256([]byte(strings.Join([]string{registryName, harborProject, permission}, "\x00")))
+	return workload.TokenID + "#" + hex.EncodeToString(sum[:16])
+}
+
+// replayKey identifies the concurrent duplicates of a token use, so they pass
+// the replay check once. Uses of tokens without an ID get an empty key.
+func replayKey(use string) string {
+	if use == "" {
+		return ""
+	}
+	return "token\x00" + use
+}
+
+// checkReplay records the token use and handles a replay according to the matched
+// rules. A replay is deduplicated only if every rule allows it: the credentials
+// previously issued to the job are revoked before new ones are issued. It returns
+// errTokenReused if the replay is rejected.
+func (h *Handler) checkReplay(ctx context.Context, workload *identity.Identity, use string, projects []ProjectRequest, rules []*policy.PolicyRule) error {
+	replayed, err := h.replayGuard.Check(ctx, use, workload.ExpiresAt)
+	if err != nil {
+		return &replayError{message: "failed to check token replay", err: err}
+	}
+	if !replayed {
+		return nil
+	}
+
+	deduplicate := workload.JobID != ""
+	for _, rule := range rules {
+		if !rule.DeduplicatesReplays() {
+			deduplicate = false
+		}
+	}
+	if !deduplicate {
+		for _, project := range projects {
+			h.logger.AuditTokenReplayed(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, "rejected: token has already been used", workload.RunID, workload.JobID)
+		}
+		return errTokenReused
+	}
+
+	if _, err := h.reaper.RevokeJob(ctx, workload.PolicyNamespace, workload.JobID); err != nil {
+		return &replayError{message: "failed to revoke previous credentials", err: err}
+	}
+	if h.robotPool != nil {
+		if _, err := h.robotPool.RevokeJob(ctx, workload.PolicyNamespace, workload.JobID); err != nil {
+			return &replayError{message: "failed to revoke previous credentials", err: err}
+		}
+	}
+	for _, project := range projects {
+		h.logger.AuditTokenReplayed(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, "deduplicated: previous credentials revoked", workload.RunID, workload.JobID)
+	}
+	return nil
+}
+
+// projectRequests returns the requested projects, either from the projects
+// list or from the single harbor_project/permissions pair
+func (req *TokenRequest) projectRequests() ([]ProjectRequest, error) {
+	projects := req.Projects
+	if len(projects) == 0 {
+		if req.HarborProject == "" {
+			return nil, fmt.Errorf("harbor_project is required")
+		}
+		if req.Permissions == "" {
+			return nil, fmt.Errorf("permissions is required")
+		}
+		projects = []ProjectRequest{{HarborProject: req.HarborProject, Permission: req.Permissions}}
+	} else if req.HarborProject != "" || req.Permissions != "" {
+		return nil, fmt.Errorf("use either harbor_project/permissions or projects, not both")
+	}
+
+	seen := make(map[string]bool)
+	for i, project := range projects {
+		if project.HarborProject == "" {
+			return nil, fmt.Errorf("projects[%d]: harbor_project is required", i)
+		}
+		if seen[project.HarborProject] {
+			return nil, fmt.Errorf("projects[%d]: duplicate harbor_project '%s'", i, project.HarborProject)
+		}
+		seen[project.HarborProject] = true
+
+		if project.Permission == "" {
+			return nil, fmt.Errorf("projects[%d]: permission is required", i)
+		}
+	}
+
+	return projects, nil
+}
+
+// HandleRevoke handles POST /revoke requests.
+// It deletes every robot account issued to the calling job, or to its whole
+// pipeline when scope is "pipeline", so jobs can clean up in after_script.
+func (h *Handler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST method
+	if r.Method != http.MethodPost {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx := r.Context()
+
+	// Authenticate the CI job
+	workload, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Parse optional request body
+	var req RevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	var revoked []reaper.TrackedRobot
+	var leases []pool.Lease
+	var err error
+	switch req.Scope {
+	case "", "job":
+		if workload.JobID == "" {
+			h.respondError(w, http.StatusBadRequest, "token has no job ID")
+			return
+		}
+		revoked, err = h.reaper.RevokeJob(ctx, workload.PolicyNamespace, workload.JobID)
+		if err == nil && h.robotPool != nil {
+			leases, err = h.robotPool.RevokeJob(ctx, workload.PolicyNamespace, workload.JobID)
+		}
+	case "pipeline":
+		if workload.RunID == "" {
+			h.respondError(w, http.StatusBadRequest, "token has no pipeline ID")
+			return
+		}
+		revoked, err = h.reaper.RevokePipeline(ctx, workload.PolicyNamespace, workload.RunID)
+		if err == nil && h.robotPool != nil {
+			leases, err = h.robotPool.RevokePipeline(ctx, workload.PolicyNamespace, workload.RunID)
+		}
+	default:
+		h.respondError(w, http.StatusBadRequest, "invalid scope: must be 'job' or 'pipeline'")
+		return
+	}
+
+	if err != nil {
+		h.logger.Error("Failed to revoke robot accounts", err)
+		h.respondError(w, http.StatusInternalServerError, "failed to revoke credentials")
+		return
+	}
+
+	response := RevokeResponse{Revoked: make([]string, 0, len(revoked)+len(leases))}
+	for _, robot := range revoked {
+		response.Revoked = append(response.Revoked, robot.Name)
+	}
+	for _, lease := range leases {
+		response.Revoked = append(response.Revoked, lease.RobotName)
 	}
 
 	h.respondJSON(w, http.StatusOK, response)
 }
 
+// HandleEvaluatePolicy handles POST /api/policies/evaluate requests.
+// It explains the policy decision for a set of claims without issuing credentials.
+func (h *Handler) HandleEvaluatePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req EvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// Validate request
+	if req.HarborProject == "" {
+		h.respondError(w, http.StatusBadRequest, "harbor_project is required")
+		return
+	}
+	if _, ok := h.registries.Get(req.Registry); !ok {
+		h.respondError(w, http.StatusBadRequest, fmt.Sprintf("unknown registry '%s'", req.Registry))
+		return
+	}
+	if err := h.profiles.ValidatePermission(r.Context(), req.Permission); errors.Is(err, policy.ErrUnknownPermission) {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		h.logger.Error("Failed to resolve permission profile", err)
+		h.respondError(w, http.StatusInternalServerError, "failed to resolve permission profile")
+		return
+	}
+
+	var workload *identity.Identity
+	var err error
+	switch {
+	case req.Token != "" && req.Claims != nil:
+		h.respondError(w, http.StatusBadRequest, "only one of token or claims may be set")
+		return
+	case req.Token != "":
+		workload, err = h.authenticator.Authenticate(req.Token)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid token: %v", err))
+			return
+		}
+	case req.Claims != nil:
+		workload, err = h.authenticator.FromClaims(req.PolicyNamespace, req.Claims)
+		if err != nil {
+			h.respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid claims: %v", err))
+			return
+		}
+	default:
+		h.respondError(w, http.StatusBadRequest, "token or claims is required")
+		return
+	}
+
+	decision, err := h.policyEngine.Evaluate(r.Context(), workload, req.Registry, req.HarborProject, req.Permission)
+	if err != nil {
+		h.logger.Error("Failed to evaluate policy", err)
+		h.respondError(w, http.StatusInternalServerError, "failed to evaluate policy")
+		return
+	}
+
+	h.respondJSON(w, http.StatusOK, decision)
+}
+
 // HandleHealth handles GET /health requests
 func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -145,6 +538,78 @@ func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// HandleReady handles GET /ready requests.
+// It reports 503 unless every configured registry is reachable.
+func (h *Handler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := ReadyResponse{Status: "ok", Registries: make(map[string]string)}
+	status := http.StatusOK
+	for _, name := range h.registries.Names() {
+		backend, _ := h.registries.Get(name)
+		if err := backend.Health(r.Context()); err != nil {
+			response.Registries[registry.DisplayName(name)] = err.Error()
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		response.Registries[registry.DisplayName(name)] = "ok"
+	}
+
+	h.respondJSON(w, status, response)
+}
+
+// effectiveTTL computes the credential TTL in minutes for a granted request.
+// The requested TTL falls back to the rule default and the global robot TTL,
+// and is clamped to the rule maximum and the remaining lifetime of the CI JWT.
+func (h *Handler) effectiveTTL(rule *policy.PolicyRule, requested int, workload *identity.Identity) (int, error) {
+	ttl := rule.TTLMinutes(requested, h.robotTTL)
+	if h.maxTTL > 0 && ttl > h.maxTTL {
+		ttl = h.maxTTL
+	}
+
+	if !workload.ExpiresAt.IsZero() {
+		remaining := int(time.Until(workload.ExpiresAt) / time.Minute)
+		if remaining < 1 {
+			return 0, fmt.Errorf("token expires in less than a minute")
+		}
+		if ttl > remaining {
+			ttl = remaining
+		}
+	}
+
+	return ttl, nil
+}
+
+// authenticate validates the bearer JWT of a request and writes an error response on failure
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*identity.Identity, bool) {
+	// Extract JWT from Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		h.respondError(w, http.StatusUnauthorized, "missing authorization header")
+		return nil, false
+	}
+
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if tokenString == authHeader {
+		h.respondError(w, http.StatusUnauthorized, "invalid authorization header format")
+		return nil, false
+	}
+
+	// Validate JWT and resolve the workload identity
+	workload, err := h.authenticator.Authenticate(tokenString)
+	if err != nil {
+		h.logger.Error("JWT validation failed", err)
+		h.respondError(w, http.StatusUnauthorized, "invalid or expired token")
+		return nil, false
+	}
+
+	return workload, true
+}
+
 // respondJSON sends a JSON response
 func (h *Handler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
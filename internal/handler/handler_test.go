@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/replay"
+)
+
+func TestCheckReplaySameTokenDifferentRequests(t *testing.T) {
+	h := &Handler{replayGuard: replay.NewGuard(), logger: logging.NewLogger()}
+	// Without a job ID, replays are rejected rather than deduplicated
+	workload := &identity.Identity{TokenID: "token-1", ExpiresAt: time.Now().Add(time.Hour)}
+
+	requests := []struct {
+		registry string
+		projects []ProjectRequest
+	}{
+		{"", []ProjectRequest{{HarborProject: "frontend", Permission: "read"}}},
+		{"", []ProjectRequest{{HarborProject: "backend", Permission: "read"}}},
+		{"", []ProjectRequest{{HarborProject: "frontend", Permission: "write"}}},
+		{"harbor-dr", []ProjectRequest{{HarborProject: "frontend", Permission: "read"}}},
+		{"", []ProjectRequest{{HarborProject: "frontend", Permission: "read"}, {HarborProject: "backend", Permission: "read"}}},
+	}
+
+	ctx := context.Background()
+	for _, req := range requests {
+		use := replayUse(workload, req.registry, req.projects)
+		if err := h.checkReplay(ctx, workload, use, req.projects, nil); err != nil {
+			t.Errorf("first use for registry %q, projects %v: got %v, want nil", req.registry, req.projects, err)
+		}
+	}
+	for _, req := range requests {
+		use := replayUse(workload, req.registry, req.projects)
+		if err := h.checkReplay(ctx, workload, use, req.projects, nil); !errors.Is(err, errTokenReused) {
+			t.Errorf("repeated use for registry %q, projects %v: got %v, want errTokenReused", req.registry, req.projects, err)
+		}
+	}
+}
+
+func TestReplayUse(t *testing.T) {
+	projects := []ProjectRequest{{HarborProject: "frontend", Permission: "read"}}
+
+	if use := replayUse(&identity.Identity{}, "", projects); use != "" {
+		t.Errorf("token without ID: got %q, want empty", use)
+	}
+
+	a := replayUse(&identity.Identity{TokenID: "token-1"}, "", projects)
+	b := replayUse(&identity.Identity{TokenID: "token-2"}, "", projects)
+	if a == b {
+		t.Errorf("different tokens share use %q", a)
+	}
+	if again := replayUse(&identity.Identity{TokenID: "token-1"}, "", projects); again != a {
+		t.Errorf("same token and request: got %q, want %q", again, a)
+	}
+}
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/policy"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/pool"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/reaper"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/registry"
+)
+
+// sharedSecret is the secret of a shared pipeline robot
+type sharedSecret struct {
+	secret     string
+	validUntil time.Time // when Harbor expires the robot
+}
+
+// sharedRobot identifies a shared robot; robot IDs are only unique per registry
+type sharedRobot struct {
+	registry string
+	id       int64
+}
+
+// sharedSecrets keeps the secrets of shared pipeline robots, so later jobs of a
+// pipeline get the same credential. Secrets are only held in memory; after a
+// restart, the next job of a pipeline gets a new shared robot.
+type sharedSecrets struct {
+	mu      sync.Mutex
+	secrets map[sharedRobot]sharedSecret
+}
+
+// newSharedSecrets creates an empty secret store
+func newSharedSecrets() *sharedSecrets {
+	return &sharedSecrets{
+		secrets: make(map[sharedRobot]sharedSecret),
+	}
+}
+
+// get returns the secret of a shared robot if it is known
+func (s *sharedSecrets) get(registryName string, robotID int64) (sharedSecret, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.secrets[sharedRobot{registry: registryName, id: robotID}]
+	return secret, ok
+}
+
+// put stores the secret of a shared robot and drops secrets of robots the registry has expired
+func (s *sharedSecrets) put(registryName string, robotID int64, secret sharedSecret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for robot, known := range s.secrets {
+		if !known.validUntil.After(now) {
+			delete(s.secrets, robot)
+		}
+	}
+	s.secrets[sharedRobot{registry: registryName, id: robotID}] = secret
+}
+
+// robotScope returns the scope of the robot issued for a request: one robot per
+// pipeline if every matched rule asks for it and the token names a pipeline,
+// otherwise one robot per job
+func robotScope(workload *identity.Identity, rules []*policy.PolicyRule) string {
+	if workload.RunID == "" {
+		return policy.RobotScopeJob
+	}
+	for _, rule := range rules {
+		if !rule.SharesPipelineRobot() {
+			return policy.RobotScopeJob
+		}
+	}
+	return policy.RobotScopePipeline
+}
+
+// issuanceKey identifies a credential by job or pipeline, registry, Harbor projects and permissions.
+// Tokens without a job ID cannot be matched to earlier requests and get an empty key.
+func issuanceKey(workload *identity.Identity, registryName string, projects []ProjectRequest, scope string) string {
+	owner := workload.JobID
+	if scope == policy.RobotScopePipeline {
+		owner = workload.RunID
+	}
+	if owner == "" {
+		return ""
+	}
+	harborProject, permission := joinProjects(projects)
+	return strings.Join([]string{workload.PolicyNamespace, scope, owner, registryName, harborProject, permission}, "\x00")
+}
+
+// robotOwner names the job a robot is issued to. Tokens without a job ID get a
+// random name, so robots of parallel jobs created in the same second do not collide.
+func robotOwner(workload *identity.Identity) string {
+	if workload.JobID != "" {
+		return workload.JobID
+	}
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return "anon-" + hex.EncodeToString(buf)
+}
+
+// joinProjects returns the Harbor projects and permissions of a request as
+// comma-separated lists, the form in which issued robots are tracked
+func joinProjects(projects []ProjectRequest) (string, string) {
+	harborProjects := make([]string, 0, len(projects))
+	permissions := make([]string, 0, len(projects))
+	for _, project := range projects {
+		harborProjects = append(harborProjects, project.HarborProject)
+		permissions = append(permissions, project.Permission)
+	}
+	return strings.Join(harborProjects, ","), strings.Join(permissions, ",")
+}
+
+// issueCredential returns a credential for the requested projects. If the job
+// already holds an unexpired robot for the same projects and permissions, for
+// example because it retried after a network error, the robot's secret is
+// rotated instead of creating another robot. Only then is a pool robot leased,
+// so a retry never gets a second live credential; a job retrying a pool lease
+// gets the same pool robot with a new secret.
+func (h *Handler) issueCredential(ctx context.Context, workload *identity.Identity, registryName string, projects []ProjectRequest, grants []harbor.ProjectGrant, ttlMinutes int) (*issuedCredential, error) {
+	harborProject, permission := joinProjects(projects)
+	backend, ok := h.registries.Get(registryName)
+	if !ok {
+		return nil, fmt.Errorf("registry '%s' is not configured", registryName)
+	}
+
+	refresher, canRotate := backend.(registry.SecretRefresher)
+	if workload.JobID != "" && canRotate {
+		existing, found, err := h.reaper.ActiveRobot(ctx, registryName, workload.PolicyNamespace, workload.JobID, harborProject, permission)
+		if err != nil {
+			return nil, err
+		}
+		// Never hand out a robot that outlives the lifetime granted to this request
+		if found && !existing.ExpiresAt.After(time.Now().Add(time.Duration(ttlMinutes)*time.Minute)) {
+			secret, err := refresher.RefreshRobotSecret(ctx, existing.ID)
+			if err == nil {
+				remaining := int(math.Ceil(time.Until(existing.ExpiresAt).Minutes()))
+				for _, project := range projects {
+					h.logger.AuditTokenRotated(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, existing.ID, existing.Name, existing.ExpiresAt, remaining, workload.RunID, workload.JobID, policy.RobotScopeJob, registryName)
+				}
+				return &issuedCredential{
+					robot: &harbor.RobotAccount{
+						ID:        existing.ID,
+						Name:      existing.Name,
+						Secret:    secret,
+						ExpiresAt: existing.ExpiresAt,
+					},
+					ttlMinutes: remaining,
+				}, nil
+			}
+			if !errors.Is(err, harbor.ErrRobotNotFound) {
+				return nil, fmt.Errorf("failed to rotate robot secret: %w", err)
+			}
+			// The robot is gone from the registry; issue a new one
+		}
+	}
+
+	// Lease a pre-provisioned robot if the project has a pool for the permission;
+	// pools only exist in the default Harbor instance
+	if h.robotPool != nil && registryName == registry.DefaultName && len(projects) == 1 {
+		credential, ok, err := h.leasePoolRobot(ctx, workload, projects[0], ttlMinutes)
+		if err != nil {
+			h.logger.Error("Failed to lease pool robot, creating a robot instead", err)
+		} else if ok {
+			return credential, nil
+		}
+	}
+
+	robotName := fmt.Sprintf("%s%s-%d", harbor.RobotNamePrefix, robotOwner(workload), time.Now().Unix())
+	robot, err := h.createRobot(ctx, workload, backend, registryName, projects, grants, robotName, ttlMinutes, policy.RobotScopeJob)
+	if err != nil {
+		return nil, err
+	}
+
+	return &issuedCredential{robot: robot, ttlMinutes: ttlMinutes}, nil
+}
+
+// leasePoolRobot hands out an idle pool robot with a fresh secret until the credential expires
+func (h *Handler) leasePoolRobot(ctx context.Context, workload *identity.Identity, project ProjectRequest, ttlMinutes int) (*issuedCredential, bool, error) {
+	robot, ok, err := h.robotPool.Acquire(ctx, pool.Lease{
+		IdentitySource:  workload.Source,
+		PolicyNamespace: workload.PolicyNamespace,
+		GitLabProject:   workload.Repository,
+		HarborProject:   project.HarborProject,
+		Permission:      project.Permission,
+		PipelineID:      workload.RunID,
+		JobID:           workload.JobID,
+		ExpiresAt:       time.Now().Add(time.Duration(ttlMinutes) * time.Minute),
+	})
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	h.logger.AuditTokenIssued(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, robot.ID, robot.Name, robot.ExpiresAt, ttlMinutes, workload.RunID, workload.JobID, pool.RobotScope, registry.DefaultName)
+
+	return &issuedCredential{robot: robot, ttlMinutes: ttlMinutes}, true, nil
+}
+
+// issueSharedCredential returns the credential of the pipeline's shared robot
+// for the requested projects, creating the robot for the first job. Each job
+// extends the robot's expiry to its own, so the robot is deleted once the last
+// credential handed out for it expires.
+func (h *Handler) issueSharedCredential(ctx context.Context, workload *identity.Identity, registryName string, projects []ProjectRequest, grants []harbor.ProjectGrant, ttlMinutes int) (*issuedCredential, error) {
+	harborProject, permission := joinProjects(projects)
+	expiresAt := time.Now().Add(time.Duration(ttlMinutes) * time.Minute)
+	backend, ok := h.registries.Get(registryName)
+	if !ok {
+		return nil, fmt.Errorf("registry '%s' is not configured", registryName)
+	}
+
+	existing, found, err := h.reaper.ActivePipelineRobot(ctx, registryName, workload.PolicyNamespace, workload.RunID, harborProject, permission)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		// Reuse the robot only if its secret is known and the registry keeps it valid long enough
+		if secret, ok := h.sharedSecrets.get(registryName, existing.ID); ok && !expiresAt.After(secret.validUntil) {
+			if expiresAt.After(existing.ExpiresAt) {
+				existing.ExpiresAt = expiresAt
+				h.reaper.Track(existing)
+			}
+			for _, project := range projects {
+				h.logger.AuditTokenIssued(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, existing.ID, existing.Name, expiresAt, ttlMinutes, workload.RunID, workload.JobID, policy.RobotScopePipeline, registryName)
+			}
+			return &issuedCredential{
+				robot: &harbor.RobotAccount{
+					ID:        existing.ID,
+					Name:      existing.Name,
+					Secret:    secret.secret,
+					ExpiresAt: expiresAt,
+				},
+				ttlMinutes: ttlMinutes,
+			}, nil
+		}
+	}
+
+	robotName := fmt.Sprintf("%spipeline-%s-%d", harbor.RobotNamePrefix, workload.RunID, time.Now().Unix())
+	robot, err := h.createRobot(ctx, workload, backend, registryName, projects, grants, robotName, ttlMinutes, policy.RobotScopePipeline)
+	if err != nil {
+		return nil, err
+	}
+	h.sharedSecrets.put(registryName, robot.ID, sharedSecret{secret: robot.Secret, validUntil: robot.ValidUntil})
+
+	return &issuedCredential{robot: robot, ttlMinutes: ttlMinutes}, nil
+}
+
+// createRobot issues a credential in the registry, tracks it and writes the audit log
+func (h *Handler) createRobot(ctx context.Context, workload *identity.Identity, backend registry.Backend, registryName string, projects []ProjectRequest, grants []harbor.ProjectGrant, robotName string, ttlMinutes int, scope string) (*harbor.RobotAccount, error) {
+	robot, err := backend.IssueCredential(ctx, robotName, grants, ttlMinutes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Track the robot for revocation and deletion once the credential expires
+	harborProject, permission := joinProjects(projects)
+	h.reaper.Track(reaper.TrackedRobot{
+		Registry:        registryName,
+		ID:              robot.ID,
+		Name:            robot.Name,
+		IdentitySource:  workload.Source,
+		PolicyNamespace: workload.PolicyNamespace,
+		GitLabProject:   workload.Repository,
+		HarborProject:   harborProject,
+		Permission:      permission,
+		PipelineID:      workload.RunID,
+		JobID:           workload.JobID,
+		RobotScope:      scope,
+		ExpiresAt:       robot.ExpiresAt,
+	})
+
+	// Log one audit event per project
+	for _, project := range projects {
+		h.logger.AuditTokenIssued(workload.Source, workload.PolicyNamespace, workload.Repository, project.HarborProject, project.Permission, robot.ID, robot.Name, robot.ExpiresAt, ttlMinutes, workload.RunID, workload.JobID, scope, registryName)
+	}
+
+	return robot, nil
+}
@@ -0,0 +1,180 @@
+package harbor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthProvider authenticates the broker's own requests to Harbor
+type AuthProvider interface {
+	// Authorize adds the broker's credentials to a request
+	Authorize(req *http.Request) error
+	// Identity returns the Harbor account the broker acts as, for logs
+	Identity() string
+}
+
+// basicAuth authenticates with a fixed username and password. Harbor accepts
+// the same scheme for local users, system robot accounts (robot$name and its
+// secret) and OIDC users (username and CLI secret).
+type basicAuth struct {
+	username string
+	password string
+}
+
+// NewBasicAuth creates an auth provider with a fixed username and password
+func NewBasicAuth(username, password string) AuthProvider {
+	return &basicAuth{username: username, password: password}
+}
+
+func (a *basicAuth) Authorize(req *http.Request) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+func (a *basicAuth) Identity() string {
+	return a.username
+}
+
+// secretFileAuth authenticates with a username and a secret read from a file.
+// The file is read again when it changes, so a rotated robot secret or CLI
+// secret, e.g. in a mounted Kubernetes secret, is picked up without a restart.
+type secretFileAuth struct {
+	username string
+	path     string
+
+	mu      sync.Mutex
+	secret  string
+	modTime time.Time
+}
+
+// NewSecretFileAuth creates an auth provider that reads the secret from a file
+func NewSecretFileAuth(username, path string) (AuthProvider, error) {
+	a := &secretFileAuth{username: username, path: path}
+	if _, err := a.currentSecret(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *secretFileAuth) Authorize(req *http.Request) error {
+	secret, err := a.currentSecret()
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(a.username, secret)
+	return nil
+}
+
+func (a *secretFileAuth) Identity() string {
+	return a.username
+}
+
+// currentSecret returns the secret, reading the file again if it was modified
+func (a *secretFileAuth) currentSecret() (string, error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Harbor secret file: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.secret != "" && info.ModTime().Equal(a.modTime) {
+		return a.secret, nil
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Harbor secret file: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("Harbor secret file %s is empty", a.path)
+	}
+	a.secret = secret
+	a.modTime = info.ModTime()
+	return a.secret, nil
+}
+
+// RequiredPermissions are the system-level permissions the broker's identity
+// needs: managing robot accounts and looking up projects
+var RequiredPermissions = []Access{
+	{Resource: "project", Action: "list"},
+	{Resource: "robot", Action: "create"},
+	{Resource: "robot", Action: "delete"},
+	{Resource: "robot", Action: "list"},
+	{Resource: "robot", Action: "read"},
+	{Resource: "robot", Action: "update"},
+}
+
+// PermissionReport compares the permissions of the broker's identity with RequiredPermissions
+type PermissionReport struct {
+	Identity string
+	Missing  []Access // required but not granted
+	Excess   []Access // granted but not required
+}
+
+// VerifyPermissions reads the system-level permissions of the broker's identity
+// from Harbor and compares them with RequiredPermissions
+func (c *Client) VerifyPermissions(ctx context.Context) (*PermissionReport, error) {
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v2.0/users/current/permissions?scope=/system&relative=true", nil)
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var granted []Access
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return nil, fmt.Errorf("failed to decode permissions: %w", err)
+	}
+
+	grantedSet := make(map[Access]bool, len(granted))
+	for _, access := range granted {
+		grantedSet[access] = true
+	}
+	requiredSet := make(map[Access]bool, len(RequiredPermissions))
+	for _, access := range RequiredPermissions {
+		requiredSet[access] = true
+	}
+
+	report := &PermissionReport{Identity: c.auth.Identity()}
+	for _, access := range RequiredPermissions {
+		if !grantedSet[access] {
+			report.Missing = append(report.Missing, access)
+		}
+	}
+	for access := range grantedSet {
+		if !requiredSet[access] {
+			report.Excess = append(report.Excess, access)
+		}
+	}
+	sort.Slice(report.Excess, func(i, j int) bool {
+		if report.Excess[i].Resource != report.Excess[j].Resource {
+			return report.Excess[i].Resource < report.Excess[j].Resource
+		}
+		return report.Excess[i].Action < report.Excess[j].Action
+	})
+
+	return report, nil
+}
+
+// FormatPermissions returns permissions as a comma-separated list of resource:action pairs
+func FormatPermissions(permissions []Access) string {
+	parts := make([]string, 0, len(permissions))
+	for _, access := range permissions {
+		parts = append(parts, access.Resource+":"+access.Action)
+	}
+	return strings.Join(parts, ", ")
+}
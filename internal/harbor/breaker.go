@@ -0,0 +1,111 @@
+package harbor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is matched by errors returned while Harbor is considered down
+var ErrCircuitOpen = errors.New("harbor circuit breaker is open")
+
+// CircuitOpenError is returned without calling Harbor while the circuit is open
+type CircuitOpenError struct {
+	RetryAfter time.Duration // when the next call may be attempted
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrCircuitOpen, e.RetryAfter.Round(time.Second))
+}
+
+// Is makes the error match ErrCircuitOpen
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// circuitBreaker stops calls to Harbor after consecutive failures, so callers
+// fail fast instead of piling up behind timeouts. Once the open duration has
+// passed, a single probe call is let through; its outcome closes or reopens
+// the circuit.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// newCircuitBreaker creates a closed circuit breaker; a zero threshold disables it
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+	}
+}
+
+// allow returns an error if a call must not be attempted
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return &CircuitOpenError{RetryAfter: wait}
+	}
+	if b.probing {
+		// Another call is probing whether Harbor is back
+		return &CircuitOpenError{RetryAfter: time.Second}
+	}
+	b.probing = true
+	return nil
+}
+
+// success records a call that reached Harbor and closes the circuit
+func (b *circuitBreaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a failed call and opens the circuit once the threshold is reached
+func (b *circuitBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.openDuration)
+		b.probing = false
+	}
+}
+
+// abandon records a call whose caller gave up; it neither closes nor opens the circuit
+func (b *circuitBreaker) abandon() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
@@ -2,19 +2,42 @@ package harbor
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
+// RobotNamePrefix is the name prefix of every robot account created by the broker
+const RobotNamePrefix = "ci-temp-"
+
+// PoolRobotNamePrefix is the name prefix of pre-provisioned pool robot accounts.
+// It differs from RobotNamePrefix so the orphan sweep leaves pool robots alone.
+const PoolRobotNamePrefix = "ci-pool-"
+
+// ErrRobotNotFound is returned when a robot account does not exist in Harbor
+var ErrRobotNotFound = errors.New("robot account not found")
+
+// ErrProjectNotFound is returned when a project does not exist in Harbor
+var ErrProjectNotFound = errors.New("project not found")
+
 // Client is a Harbor API client
 type Client struct {
 	baseURL  string
-	username string
-	password string
+	hostname string // registry host that robot credentials are used with
+	auth     AuthProvider
 	client   *http.Client
+	projects *projectCache
+	retry    RetryOptions
+	breaker  *circuitBreaker
 }
 
 // RobotAccount represents a Harbor robot account
@@ -22,7 +45,27 @@ type RobotAccount struct {
 	ID        int64     `json:"id"`
 	Name      string    `json:"name"`
 	Secret    string    `json:"secret"`
-	ExpiresAt time.Time `json:"expires_at"`
+	ExpiresAt time.Time `json:"-"` // intended expiry, computed from the TTL
+	// ValidUntil is when Harbor itself expires the robot, at least one day after
+	// creation; zero for robots that never expire
+	ValidUntil time.Time `json:"-"`
+}
+
+// RobotInfo represents a robot account as returned by the Harbor robot list API
+type RobotInfo struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Level        string    `json:"level"`
+	CreationTime time.Time `json:"creation_time"`
+	ExpiresAt    int64     `json:"expires_at"` // unix timestamp, -1 for never expire
+}
+
+// ValidUntil returns when Harbor expires the robot; zero for robots that never expire
+func (r RobotInfo) ValidUntil() time.Time {
+	if r.ExpiresAt <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(r.ExpiresAt, 0)
 }
 
 // CreateRobotRequest represents the request to create a robot account
@@ -53,39 +96,201 @@ type Project struct {
 	Name      string `json:"name"`
 }
 
-// NewClient creates a new Harbor API client
-func NewClient(baseURL, username, password string) *Client {
+// NewClient creates a new Harbor API client that authenticates as the identity
+// of auth. Project lookups are cached for
+// projectCacheTTL, and missing projects for negativeCacheTTL. Calls time out,
+// are retried and guarded by a circuit breaker according to retry.
+func NewClient(baseURL string, auth AuthProvider, tlsOptions TLSOptions, projectCacheTTL, negativeCacheTTL time.Duration, retry RetryOptions) (*Client, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid Harbor URL '%s'", baseURL)
+	}
+
+	// Calls are bounded by retry.CallTimeout through the request context
+	httpClient := &http.Client{}
+	if tlsOptions.CAFile != "" || tlsOptions.InsecureSkipVerify {
+		tlsConfig, err := tlsOptions.config()
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
 	return &Client{
 		baseURL:  baseURL,
-		username: username,
-		password: password,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		hostname: parsed.Host,
+		auth:     auth,
+		client:   httpClient,
+		projects: newProjectCache(projectCacheTTL, negativeCacheTTL),
+		retry:    retry,
+		breaker:  newCircuitBreaker(retry.FailureThreshold, retry.OpenDuration),
+	}, nil
+}
+
+// TLSOptions configures TLS to a Harbor instance with a private CA
+type TLSOptions struct {
+	CAFile             string // CA bundle that replaces the system roots
+	InsecureSkipVerify bool   // skip certificate verification; for test instances only
+}
+
+// config builds the TLS configuration for the options
+func (o TLSOptions) config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		tlsConfig.RootCAs = pool
 	}
+	return tlsConfig, nil
 }
 
-// GetProject retrieves a project by name
-func (c *Client) GetProject(projectName string) (*Project, error) {
-	url := fmt.Sprintf("%s/api/v2.0/projects?name=%s", c.baseURL, projectName)
+// Hostname returns the registry host that docker clients log in to
+func (c *Client) Hostname() string {
+	return c.hostname
+}
+
+// do sends the request built by newRequest with the broker's credentials.
+// Idempotent requests are retried with backoff on network errors and transient
+// status codes; the response of the last attempt is returned. Network errors
+// are returned as transient errors, and no request is sent while the circuit
+// breaker is open. Each attempt is bounded by the call timeout, which also
+// covers reading the response body until it is closed.
+func (c *Client) do(ctx context.Context, newRequest func(context.Context) (*http.Request, error), idempotent bool) (*http.Response, error) {
+	attempts := 1
+	if idempotent {
+		attempts += c.retry.MaxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.retry.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if c.retry.CallTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, c.retry.CallTimeout)
+		}
+
+		req, err := newRequest(attemptCtx)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if err := c.auth.Authorize(req); err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+
+		if err := c.breaker.allow(); err != nil {
+			cancel()
+			return nil, err
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			cancel()
+			// A cancelled caller says nothing about Harbor's health
+			if ctx.Err() != nil {
+				c.breaker.abandon()
+				return nil, fmt.Errorf("failed to execute request: %w", err)
+			}
+			c.breaker.failure()
+			lastErr = &transientError{err: fmt.Errorf("failed to execute request: %w", err)}
+			continue
+		}
 
-	req, err := http.NewRequest("GET", url, nil)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			c.breaker.failure()
+		} else {
+			c.breaker.success()
+		}
+
+		if retryableStatus(resp.StatusCode) && attempt < attempts-1 {
+			resp.Body.Close()
+			cancel()
+			continue
+		}
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// cancelOnClose releases the context of a call once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the call's context
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// apiError returns the error for an unexpected response status. Transient
+// statuses are returned as transient errors.
+func apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	err := fmt.Errorf("harbor API error (status %d): %s", resp.StatusCode, string(body))
+	if retryableStatus(resp.StatusCode) {
+		return &transientError{err: err}
+	}
+	return err
+}
+
+// GetProject retrieves a project by name.
+// Returns an error wrapping ErrProjectNotFound if Harbor does not know the project.
+func (c *Client) GetProject(ctx context.Context, projectName string) (*Project, error) {
+	if project, ok := c.projects.get(projectName); ok {
+		if project == nil {
+			return nil, fmt.Errorf("project '%s': %w", projectName, ErrProjectNotFound)
+		}
+		return project, nil
+	}
+
+	project, err := c.fetchProject(ctx, projectName)
+	if errors.Is(err, ErrProjectNotFound) {
+		c.projects.put(projectName, nil)
+		return nil, err
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
 
-	req.SetBasicAuth(c.username, c.password)
-	req.Header.Set("Accept", "application/json")
+	c.projects.put(projectName, project)
+	return project, nil
+}
+
+// fetchProject looks up a project by name in Harbor
+func (c *Client) fetchProject(ctx context.Context, projectName string) (*Project, error) {
+	url := fmt.Sprintf("%s/api/v2.0/projects?name=%s", c.baseURL, projectName)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	}, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("harbor API error (status %d): %s", resp.StatusCode, string(body))
+		return nil, apiError(resp)
 	}
 
 	var projects []Project
@@ -94,37 +299,72 @@ func (c *Client) GetProject(projectName string) (*Project, error) {
 	}
 
 	if len(projects) == 0 {
-		return nil, fmt.Errorf("project '%s' not found", projectName)
+		return nil, fmt.Errorf("project '%s': %w", projectName, ErrProjectNotFound)
 	}
 
 	return &projects[0], nil
 }
 
-// CreateRobotAccount creates a new robot account for a project
-func (c *Client) CreateRobotAccount(projectName, robotName, permission string, ttlMinutes int) (*RobotAccount, error) {
-	// First, get the project to obtain its ID
-	project, err := c.GetProject(projectName)
+// ProjectGrant represents the access actions granted on a single Harbor project
+type ProjectGrant struct {
+	Project string
+	Access  []Access
+}
+
+// IssueCredential creates a robot account with the access of every grant.
+// A single project gets a project-level robot; several projects share one
+// system-level robot, so one credential covers all of them.
+func (c *Client) IssueCredential(ctx context.Context, name string, grants []ProjectGrant, ttlMinutes int) (*RobotAccount, error) {
+	if len(grants) == 1 {
+		return c.CreateRobotAccount(ctx, grants[0].Project, name, grants[0].Access, ttlMinutes)
+	}
+	return c.CreateSystemRobotAccount(ctx, grants, name, ttlMinutes)
+}
+
+// RevokeCredential deletes an issued robot account.
+// Returns ErrRobotNotFound if Harbor does not know the robot.
+func (c *Client) RevokeCredential(ctx context.Context, id int64) error {
+	return c.DeleteRobotAccount(ctx, id)
+}
+
+// Health checks that Harbor answers its health API
+func (c *Client) Health(ctx context.Context) error {
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v2.0/health", nil)
+	}, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get project: %w", err)
+		return err
 	}
+	defer resp.Body.Close()
 
-	// Map permission to Harbor access actions
-	access := c.mapPermissionToAccess(permission)
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	return nil
+}
 
-	// Create robot account request
-	// NOTE: Harbor API's duration field expects days and has a minimum of 1 day.
-	// For short-lived credentials (< 1 day), we set duration to 1 day but rely on
-	// our application logic to only use the credentials for the specified TTL.
-	// The expires_at timestamp we return to clients reflects the actual intended TTL.
-	durationDays := int64(1) // Minimum allowed by Harbor API
-	if ttlMinutes >= 24*60 {
-		// If TTL is 1 day or more, convert properly
-		durationDays = int64(float64(ttlMinutes)/(60.0*24.0) + 0.5)
+// CreateRobotAccount creates a new robot account for a project
+func (c *Client) CreateRobotAccount(ctx context.Context, projectName, robotName string, access []Access, ttlMinutes int) (*RobotAccount, error) {
+	return c.createProjectRobot(ctx, projectName, robotName, "Temporary CI robot account", robotDurationDays(ttlMinutes), access, ttlMinutes)
+}
+
+// CreatePoolRobotAccount creates a robot account for a project that Harbor
+// expires after durationDays. Pool robots are handed out by refreshing their secret.
+func (c *Client) CreatePoolRobotAccount(ctx context.Context, projectName, robotName string, access []Access, durationDays int64) (*RobotAccount, error) {
+	return c.createProjectRobot(ctx, projectName, robotName, "Pooled CI robot account", durationDays, access, 0)
+}
+
+// createProjectRobot creates a project-level robot account with the given duration in days
+func (c *Client) createProjectRobot(ctx context.Context, projectName, robotName, description string, durationDays int64, access []Access, ttlMinutes int) (*RobotAccount, error) {
+	// First, get the project to obtain its ID
+	project, err := c.GetProject(ctx, projectName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project: %w", err)
 	}
 
 	request := CreateRobotRequest{
 		Name:        robotName,
-		Description: "Temporary CI robot account",
+		Description: description,
 		Duration:    durationDays,
 		Level:       "project",
 		Permissions: []Permission{
@@ -136,31 +376,117 @@ func (c *Client) CreateRobotAccount(projectName, robotName, permission string, t
 		},
 	}
 
-	body, err := json.Marshal(request)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	robot, err := c.postRobot(ctx, fmt.Sprintf("/api/v2.0/projects/%d/robots", project.ProjectID), request, ttlMinutes)
+	if errors.Is(err, ErrProjectNotFound) {
+		// The cached project ID is stale, e.g. because the project was recreated
+		c.projects.invalidate(projectName)
+		fresh, lookupErr := c.GetProject(ctx, projectName)
+		if lookupErr != nil {
+			return nil, fmt.Errorf("failed to get project: %w", lookupErr)
+		}
+		if fresh.ProjectID != project.ProjectID {
+			return c.postRobot(ctx, fmt.Sprintf("/api/v2.0/projects/%d/robots", fresh.ProjectID), request, ttlMinutes)
+		}
+	}
+	return robot, err
+}
+
+// CreateSystemRobotAccount creates a new system-level robot account with
+// permissions on several projects, so one credential covers all of them
+func (c *Client) CreateSystemRobotAccount(ctx context.Context, grants []ProjectGrant, robotName string, ttlMinutes int) (*RobotAccount, error) {
+	permissions := make([]Permission, 0, len(grants))
+	for _, grant := range grants {
+		permissions = append(permissions, Permission{
+			Kind:      "project",
+			Namespace: grant.Project,
+			Access:    grant.Access,
+		})
 	}
 
-	url := fmt.Sprintf("%s/api/v2.0/projects/%d/robots", c.baseURL, project.ProjectID)
+	request := CreateRobotRequest{
+		Name:        robotName,
+		Description: "Temporary CI robot account",
+		Duration:    robotDurationDays(ttlMinutes),
+		Level:       "system",
+		Permissions: permissions,
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	robot, err := c.postRobot(ctx, "/api/v2.0/robots", request, ttlMinutes)
+	if errors.Is(err, ErrProjectNotFound) {
+		for _, grant := range grants {
+			c.projects.invalidate(grant.Project)
+		}
+	}
+	return robot, err
+}
+
+// robotDurationDays converts a TTL in minutes to a Harbor robot duration.
+// NOTE: Harbor API's duration field expects days and has a minimum of 1 day.
+// For short-lived credentials (< 1 day), we set duration to 1 day but rely on
+// our application logic to only use the credentials for the specified TTL.
+// The expires_at timestamp we return to clients reflects the actual intended TTL.
+func robotDurationDays(ttlMinutes int) int64 {
+	durationDays := int64(1) // Minimum allowed by Harbor API
+	if ttlMinutes >= 24*60 {
+		// If TTL is 1 day or more, convert properly
+		durationDays = int64(float64(ttlMinutes)/(60.0*24.0) + 0.5)
+	}
+	return durationDays
+}
+
+// postRobot sends a robot creation request to the given API path. Creation is
+// not idempotent, so after a transient failure it is only retried if Harbor
+// does not know the robot; a robot that was created although the response was
+// lost is taken over with a fresh secret.
+func (c *Client) postRobot(ctx context.Context, path string, request CreateRobotRequest, ttlMinutes int) (*RobotAccount, error) {
+	for retry := 0; ; retry++ {
+		robot, err := c.postRobotOnce(ctx, path, request, ttlMinutes)
+		if err == nil || !isTransient(err) || retry >= c.retry.MaxRetries {
+			return robot, err
+		}
+
+		if err := sleep(ctx, c.retry.backoff(retry+1)); err != nil {
+			return nil, err
+		}
+
+		existing, found, lookupErr := c.findRobot(ctx, request.Name)
+		if lookupErr != nil {
+			return nil, err
+		}
+		if found {
+			return c.adoptRobot(ctx, existing, request, ttlMinutes)
+		}
+	}
+}
+
+// postRobotOnce sends a single robot creation request
+func (c *Client) postRobotOnce(ctx context.Context, path string, request CreateRobotRequest, ttlMinutes int) (*RobotAccount, error) {
+	body, err := json.Marshal(request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req.SetBasicAuth(c.username, c.password)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
+	url := c.baseURL + path
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
+	if resp.StatusCode == http.StatusNotFound {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("harbor API error (status %d): %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("harbor API error (status %d): %s: %w", resp.StatusCode, string(body), ErrProjectNotFound)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, apiError(resp)
 	}
 
 	var robot RobotAccount
@@ -168,27 +494,155 @@ func (c *Client) CreateRobotAccount(projectName, robotName, permission string, t
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	// Calculate expires_at based on TTL
-	robot.ExpiresAt = time.Now().Add(time.Duration(ttlMinutes) * time.Minute)
-
+	setRobotExpiry(&robot, request, ttlMinutes)
 	return &robot, nil
 }
 
-// mapPermissionToAccess maps our permission model to Harbor access actions
-func (c *Client) mapPermissionToAccess(permission string) []Access {
-	switch permission {
-	case "read":
-		return []Access{
-			{Resource: "repository", Action: "pull"},
+// findRobot looks up a robot created by the broker by its short name.
+// Harbor names project robots "<prefix><project>+<name>" and system robots "<prefix><name>".
+func (c *Client) findRobot(ctx context.Context, robotName string) (RobotInfo, bool, error) {
+	robots, err := c.ListRobotAccounts(ctx, robotName)
+	if err != nil {
+		return RobotInfo{}, false, err
+	}
+	for _, info := range robots {
+		if strings.HasSuffix(info.Name, "+"+robotName) || strings.HasSuffix(info.Name, "$"+robotName) {
+			return info, true, nil
 		}
-	case "write", "read-write":
-		// Both 'write' and 'read-write' require pull + push permissions
-		// as Harbor requires pull access to push images (to check if layers exist)
-		return []Access{
-			{Resource: "repository", Action: "pull"},
-			{Resource: "repository", Action: "push"},
+	}
+	return RobotInfo{}, false, nil
+}
+
+// adoptRobot takes over a robot whose creation response was lost by refreshing its secret
+func (c *Client) adoptRobot(ctx context.Context, info RobotInfo, request CreateRobotRequest, ttlMinutes int) (*RobotAccount, error) {
+	secret, err := c.RefreshRobotSecret(ctx, info.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh secret of robot %s: %w", info.Name, err)
+	}
+
+	robot := &RobotAccount{
+		ID:     info.ID,
+		Name:   info.Name,
+		Secret: secret,
+	}
+	setRobotExpiry(robot, request, ttlMinutes)
+	return robot, nil
+}
+
+// setRobotExpiry sets the intended expiry of a new robot and when Harbor expires it
+func setRobotExpiry(robot *RobotAccount, request CreateRobotRequest, ttlMinutes int) {
+	now := time.Now()
+	robot.ExpiresAt = now.Add(time.Duration(ttlMinutes) * time.Minute)
+	if request.Duration > 0 {
+		robot.ValidUntil = now.Add(time.Duration(request.Duration) * 24 * time.Hour)
+	}
+}
+
+// RefreshRobotSecret replaces the secret of a robot account with a new random one.
+// Returns ErrRobotNotFound if Harbor does not know the robot.
+func (c *Client) RefreshRobotSecret(ctx context.Context, robotID int64) (string, error) {
+	// An empty secret makes Harbor generate one and return it
+	body, err := json.Marshal(map[string]string{"secret": ""})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/api/v2.0/robots/%d", c.baseURL, robotID)
+
+	// Repeating a refresh is safe, only the secret of the last one is valid
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PATCH", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrRobotNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", apiError(resp)
+	}
+
+	var result struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if result.Secret == "" {
+		return "", fmt.Errorf("harbor returned no secret for robot %d", robotID)
+	}
+
+	return result.Secret, nil
+}
+
+// ListRobotAccounts lists all robot accounts whose name contains the given fragment
+func (c *Client) ListRobotAccounts(ctx context.Context, nameFragment string) ([]RobotInfo, error) {
+	const pageSize = 100
+
+	var robots []RobotInfo
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("q", "name=~"+nameFragment)
+		query.Set("page", fmt.Sprintf("%d", page))
+		query.Set("page_size", fmt.Sprintf("%d", pageSize))
+
+		url := fmt.Sprintf("%s/api/v2.0/robots?%s", c.baseURL, query.Encode())
+
+		resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", url, nil)
+		}, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := apiError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var pageRobots []RobotInfo
+		err = json.NewDecoder(resp.Body).Decode(&pageRobots)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		robots = append(robots, pageRobots...)
+		if len(pageRobots) < pageSize {
+			return robots, nil
 		}
-	default:
-		return []Access{}
 	}
 }
+
+// DeleteRobotAccount deletes a robot account by ID.
+// Returns ErrRobotNotFound if Harbor does not know the robot.
+func (c *Client) DeleteRobotAccount(ctx context.Context, robotID int64) error {
+	url := fmt.Sprintf("%s/api/v2.0/robots/%d", c.baseURL, robotID)
+
+	// A retried deletion that already succeeded reports ErrRobotNotFound
+	resp, err := c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	}, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrRobotNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package harbor
+
+import (
+	"sync"
+	"time"
+)
+
+// projectCacheEntry is a cached project lookup; project is nil for missing projects
+type projectCacheEntry struct {
+	project *Project
+	expires time.Time
+}
+
+// projectCache caches project lookups by name. Project IDs practically never
+// change, so most robot creations can skip the lookup. Missing projects are
+// cached for a shorter time, so newly created projects are picked up quickly.
+type projectCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]projectCacheEntry
+}
+
+// newProjectCache creates a project cache; a zero TTL disables caching of that kind
+func newProjectCache(ttl, negativeTTL time.Duration) *projectCache {
+	return &projectCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]projectCacheEntry),
+	}
+}
+
+// get returns a cached lookup. The second return value is false on a cache miss;
+// on a hit, a nil project means the project does not exist.
+func (c *projectCache) get(name string) (*Project, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.entries, name)
+		return nil, false
+	}
+	return entry.project, true
+}
+
+// put caches a lookup result; a nil project records the project as missing
+func (c *projectCache) put(name string, project *Project) {
+	ttl := c.ttl
+	if project == nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[name] = projectCacheEntry{project: project, expires: time.Now().Add(ttl)}
+}
+
+// invalidate removes a cached lookup, e.g. after Harbor reported the project gone
+func (c *projectCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, name)
+}
@@ -0,0 +1,74 @@
+package harbor
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryOptions controls timeouts and retries of Harbor API calls and the circuit breaker
+type RetryOptions struct {
+	CallTimeout      time.Duration // deadline of a single attempt, including reading the response; 0 for none
+	MaxRetries       int           // retries of a failed call after the first attempt
+	BaseDelay        time.Duration // backoff before the first retry, doubled for each further retry
+	MaxDelay         time.Duration // upper bound of the backoff
+	FailureThreshold int           // consecutive failures that open the circuit; 0 disables the breaker
+	OpenDuration     time.Duration // how long the circuit stays open before a probe call is let through
+}
+
+// backoff returns the delay before the given retry (starting at 1), with
+// exponential growth and jitter so that concurrent callers spread out
+func (o RetryOptions) backoff(retry int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < retry && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	if o.MaxDelay > 0 && delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Wait between half and the full delay
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sleep waits for d, or returns the context's error once it is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// transientError marks a failure that may succeed when retried, such as a
+// network error or a 502 while Harbor restarts
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+func (e *transientError) Unwrap() error { return e.err }
+
+// isTransient reports whether a call failed with a transient error
+func isTransient(err error) bool {
+	var transient *transientError
+	return errors.As(err, &transient)
+}
+
+// retryableStatus reports whether a response status indicates a transient failure
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package identity
+
+import (
+	"fmt"
+)
+
+// gitHubConditionClaims lists the GitHub Actions claims that policy conditions can refer to
+var gitHubConditionClaims = []string{
+	"sub",
+	"repository",
+	"repository_owner",
+	"repository_id",
+	"repository_visibility",
+	"ref",
+	"ref_type",
+	"ref_protected",
+	"environment",
+	"workflow",
+	"workflow_ref",
+	"job_workflow_ref",
+	"event_name",
+	"actor",
+	"base_ref",
+	"head_ref",
+	"runner_environment",
+}
+
+// gitHubProvider interprets GitHub Actions OIDC tokens
+type gitHubProvider struct{}
+
+// Name returns the provider name
+func (gitHubProvider) Name() string {
+	return ProviderGitHub
+}
+
+// ConditionClaims lists the claim names that policy conditions can refer to
+func (gitHubProvider) ConditionClaims() []string {
+	return gitHubConditionClaims
+}
+
+// Identity normalizes GitHub Actions claims.
+// GitHub tokens carry no claim that is unique per job: all jobs of a run share
+// run_id, run_attempt and the workflow refs. The job ID is therefore left empty,
+// which turns off per-job idempotency and job-scoped revocation, as keying them
+// on the run would let parallel jobs take over each other's credentials.
+func (gitHubProvider) Identity(claims map[string]interface{}) (*Identity, error) {
+	values := claimStrings(claims, gitHubConditionClaims)
+	if values["repository"] == "" {
+		return nil, fmt.Errorf("claim repository is required")
+	}
+
+	return &Identity{
+		Repository:  values["repository"],
+		Namespace:   values["repository_owner"],
+		Ref:         values["ref"],
+		Workflow:    values["workflow"],
+		Environment: values["environment"],
+		RunID:       claimString(claims["run_id"]),
+		claims:      values,
+	}, nil
+}
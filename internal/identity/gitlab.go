@@ -0,0 +1,59 @@
+package identity
+
+import (
+	"fmt"
+)
+
+// gitLabConditionClaims lists the GitLab CI claims that policy conditions can refer to
+var gitLabConditionClaims = []string{
+	"namespace_path",
+	"project_id",
+	"project_path",
+	"ref",
+	"ref_type",
+	"ref_path",
+	"ref_protected",
+	"environment",
+	"environment_protected",
+	"deployment_tier",
+	"pipeline_source",
+	"user_login",
+	"runner_id",
+	"ci_config_ref_uri",
+}
+
+// gitLabProvider interprets GitLab CI ID tokens
+type gitLabProvider struct{}
+
+// Name returns the provider name
+func (gitLabProvider) Name() string {
+	return ProviderGitLab
+}
+
+// ConditionClaims lists the claim names that policy conditions can refer to
+func (gitLabProvider) ConditionClaims() []string {
+	return gitLabConditionClaims
+}
+
+// Identity normalizes GitLab CI claims
+func (gitLabProvider) Identity(claims map[string]interface{}) (*Identity, error) {
+	values := claimStrings(claims, gitLabConditionClaims)
+	if values["project_path"] == "" {
+		return nil, fmt.Errorf("claim project_path is required")
+	}
+	// Tokens without a runner carry runner_id 0
+	if values["runner_id"] == "0" {
+		values["runner_id"] = ""
+	}
+
+	return &Identity{
+		Repository:  values["project_path"],
+		Namespace:   values["namespace_path"],
+		Ref:         values["ref"],
+		Workflow:    values["ci_config_ref_uri"],
+		Environment: values["environment"],
+		RunID:       claimString(claims["pipeline_id"]),
+		JobID:       claimString(claims["job_id"]),
+		claims:      values,
+	}, nil
+}
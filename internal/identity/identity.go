@@ -0,0 +1,193 @@
+package identity
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/jwt"
+)
+
+// Identity provider names
+const (
+	ProviderGitLab     = "gitlab"
+	ProviderGitHub     = "github"
+	ProviderKubernetes = "kubernetes"
+)
+
+// Identity is a verified CI workload identity, normalized across providers
+type Identity struct {
+	Provider        string
+	Source          string
+	PolicyNamespace string
+
+	Repository  string // GitLab project path, GitHub owner/repo or Kubernetes namespace/serviceaccount
+	Namespace   string // GitLab namespace path, GitHub repository owner or Kubernetes namespace
+	Ref         string
+	Workflow    string // GitLab CI config reference or GitHub workflow name
+	Environment string
+	RunID       string // GitLab pipeline ID or GitHub run ID
+	JobID       string // GitLab job ID or Kubernetes pod UID; empty for GitHub Actions
+	ExpiresAt   time.Time
+	TokenID     string // unique token ID for replay detection; empty if the token has none
+
+	// claims holds the provider claims that policy conditions can refer to
+	claims map[string]string
+}
+
+// Claim returns the value of a provider claim by its token name.
+// The second return value is false for claims the provider does not support in conditions.
+func (i *Identity) Claim(name string) (string, bool) {
+	provider, ok := providers[i.Provider]
+	if !ok || !contains(provider.ConditionClaims(), name) {
+		return "", false
+	}
+	return i.claims[name], true
+}
+
+// Provider turns verified token claims of a CI system into a workload identity
+type Provider interface {
+	// Name returns the provider name used in configuration
+	Name() string
+	// ConditionClaims lists the claim names that policy conditions can refer to
+	ConditionClaims() []string
+	// Identity normalizes verified token claims
+	Identity(claims map[string]interface{}) (*Identity, error)
+}
+
+// providers lists the supported identity providers by name
+var providers = map[string]Provider{
+	ProviderGitLab:     gitLabProvider{},
+	ProviderGitHub:     gitHubProvider{},
+	ProviderKubernetes: kubernetesProvider{},
+}
+
+// LookupProvider returns the identity provider with the given name
+func LookupProvider(name string) (Provider, bool) {
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// ProviderNames returns the names of all supported identity providers
+func ProviderNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsConditionClaim checks if a claim name can be used in policy conditions for a provider
+func IsConditionClaim(provider, name string) bool {
+	p, ok := providers[provider]
+	return ok && contains(p.ConditionClaims(), name)
+}
+
+// Authenticator verifies tokens and normalizes them with the provider of their source
+type Authenticator struct {
+	validator *jwt.Validator
+}
+
+// NewAuthenticator creates a new authenticator
+func NewAuthenticator(validator *jwt.Validator) *Authenticator {
+	return &Authenticator{
+		validator: validator,
+	}
+}
+
+// Authenticate validates a token and returns the workload identity it proves
+func (a *Authenticator) Authenticate(tokenString string) (*Identity, error) {
+	token, err := a.validator.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := newIdentity(token.Source, token.Claims)
+	if err != nil {
+		return nil, err
+	}
+	identity.ExpiresAt = token.ExpiresAt
+	identity.TokenID = tokenID(token.Source, token.Claims, identity.JobID)
+
+	return identity, nil
+}
+
+// FromClaims builds an identity from unverified claims for the source with the
+// given policy namespace. It is only meant for policy dry runs.
+func (a *Authenticator) FromClaims(policyNamespace string, claims map[string]interface{}) (*Identity, error) {
+	for _, source := range a.validator.Sources() {
+		if source.PolicyNamespace == policyNamespace {
+			return newIdentity(source, claims)
+		}
+	}
+	return nil, fmt.Errorf("no identity source with policy namespace '%s'", policyNamespace)
+}
+
+// newIdentity normalizes claims with the provider of a source
+func newIdentity(source jwt.Source, claims map[string]interface{}) (*Identity, error) {
+	provider, ok := providers[source.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown identity provider '%s' for source %s", source.Provider, source.Name)
+	}
+
+	identity, err := provider.Identity(claims)
+	if err != nil {
+		return nil, err
+	}
+	identity.Provider = provider.Name()
+	identity.Source = source.Name
+	identity.PolicyNamespace = source.PolicyNamespace
+
+	return identity, nil
+}
+
+// tokenID identifies a token by its jti claim, or by job ID and issue time for
+// tokens without one. It is scoped to the source, as issuers may reuse IDs.
+func tokenID(source jwt.Source, claims map[string]interface{}, jobID string) string {
+	id := claimString(claims["jti"])
+	if id == "" {
+		issuedAt := claimString(claims["iat"])
+		if jobID == "" || issuedAt == "" {
+			return ""
+		}
+		id = jobID + "@" + issuedAt
+	}
+	return source.Name + ":" + id
+}
+
+// claimStrings converts the listed claims to strings; missing claims are empty
+func claimStrings(claims map[string]interface{}, names []string) map[string]string {
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		values[name] = claimString(claims[name])
+	}
+	return values
+}
+
+// claimString formats a scalar claim value as a string
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// contains checks if a slice contains a string
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package identity
+
+import (
+	"fmt"
+	"strings"
+)
+
+// serviceAccountSubjectPrefix prefixes the sub claim of service account tokens
+const serviceAccountSubjectPrefix = "system:serviceaccount:"
+
+// kubernetesConditionClaims lists the service account token claims that policy
+// conditions can refer to; all but sub are read from the kubernetes.io claim
+var kubernetesConditionClaims = []string{
+	"sub",
+	"namespace",
+	"service_account",
+	"pod",
+	"node",
+}
+
+// kubernetesProvider interprets Kubernetes service account tokens.
+// The policy subject (gitlab_project in policies) is "<namespace>/<serviceaccount>".
+type kubernetesProvider struct{}
+
+// Name returns the provider name
+func (kubernetesProvider) Name() string {
+	return ProviderKubernetes
+}
+
+// ConditionClaims lists the claim names that policy conditions can refer to
+func (kubernetesProvider) ConditionClaims() []string {
+	return kubernetesConditionClaims
+}
+
+// Identity normalizes service account token claims.
+// Pod-bound tokens identify the job by pod UID; other tokens have no job ID.
+func (kubernetesProvider) Identity(claims map[string]interface{}) (*Identity, error) {
+	k8s, _ := claims["kubernetes.io"].(map[string]interface{})
+	sub := claimString(claims["sub"])
+
+	namespace := claimString(k8s["namespace"])
+	serviceAccount := nestedClaim(k8s, "serviceaccount", "name")
+
+	// Legacy tokens only carry the service account in sub
+	if (namespace == "" || serviceAccount == "") && strings.HasPrefix(sub, serviceAccountSubjectPrefix) {
+		parts := strings.SplitN(strings.TrimPrefix(sub, serviceAccountSubjectPrefix), ":", 2)
+		if len(parts) == 2 {
+			namespace, serviceAccount = parts[0], parts[1]
+		}
+	}
+	if namespace == "" || serviceAccount == "" {
+		return nil, fmt.Errorf("token is not a service account token")
+	}
+
+	return &Identity{
+		Repository: namespace + "/" + serviceAccount,
+		Namespace:  namespace,
+		JobID:      nestedClaim(k8s, "pod", "uid"),
+		claims: map[string]string{
+			"sub":             sub,
+			"namespace":       namespace,
+			"service_account": serviceAccount,
+			"pod":             nestedClaim(k8s, "pod", "name"),
+			"node":            nestedClaim(k8s, "node", "name"),
+		},
+	}, nil
+}
+
+// nestedClaim reads a string field of an object inside a claim, e.g. pod.name
+func nestedClaim(claims map[string]interface{}, object, field string) string {
+	nested, _ := claims[object].(map[string]interface{})
+	return claimString(nested[field])
+}
@@ -0,0 +1,298 @@
+package jwt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// discoveryPath is the OIDC discovery document path relative to the issuer
+const discoveryPath = "/.well-known/openid-configuration"
+
+// signingMethods maps JWS algorithm names to the signing methods the broker accepts
+var signingMethods = map[string]jwt.SigningMethod{
+	"RS256": jwt.SigningMethodRS256,
+	"RS384": jwt.SigningMethodRS384,
+	"RS512": jwt.SigningMethodRS512,
+	"PS256": jwt.SigningMethodPS256,
+	"PS384": jwt.SigningMethodPS384,
+	"PS512": jwt.SigningMethodPS512,
+	"ES256": jwt.SigningMethodES256,
+	"ES384": jwt.SigningMethodES384,
+	"ES512": jwt.SigningMethodES512,
+	"EdDSA": jwt.SigningMethodEdDSA,
+}
+
+// defaultAlgorithms is used when a provider does not advertise its signing algorithms;
+// RS256 is the OIDC default
+var defaultAlgorithms = []string{"RS256"}
+
+// errRefreshRateLimited is returned when a forced JWKS refetch is skipped
+var errRefreshRateLimited = errors.New("JWKS refresh rate limited")
+
+// discoveryDocument holds the fields the broker reads from an OIDC discovery document
+type discoveryDocument struct {
+	Issuer           string   `json:"issuer"`
+	JWKSURI          string   `json:"jwks_uri"`
+	SigningAlgValues []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// issuerKeys holds the discovery metadata and signing keys of one OIDC issuer
+type issuerKeys struct {
+	configured string   // issuer URL from the configuration
+	jwksURL    string   // optional override for the discovered jwks_uri
+	jwksFile   string   // optional local JWKS file, used instead of discovery
+	fileAlgs   []string // signing algorithms accepted with jwksFile
+	httpClient *http.Client
+	refresh    RefreshOptions
+
+	mu         sync.RWMutex
+	issuer     string // issuer string from the discovery document
+	algorithms []string
+	keySet     jwk.Set
+	lastFetch  time.Time
+
+	// fetchMutex serializes fetches; lastAttempt is guarded by it
+	fetchMutex  sync.Mutex
+	lastAttempt time.Time
+}
+
+// newIssuerKeys creates the key holder for an issuer of a source
+func newIssuerKeys(issuer string, src Source, refresh RefreshOptions) (*issuerKeys, error) {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	if src.CAFile != "" {
+		pem, err := os.ReadFile(src.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file for source %s: %w", src.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", src.CAFile)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	fileAlgs := src.Algorithms
+	if len(fileAlgs) == 0 {
+		fileAlgs = defaultAlgorithms
+	}
+	for _, alg := range fileAlgs {
+		if _, ok := signingMethods[alg]; !ok {
+			return nil, fmt.Errorf("unsupported signing algorithm '%s' for source %s", alg, src.Name)
+		}
+	}
+
+	return &issuerKeys{
+		configured: issuer,
+		jwksURL:    src.JWKSUrl,
+		jwksFile:   src.JWKSFile,
+		fileAlgs:   fileAlgs,
+		httpClient: httpClient,
+		refresh:    refresh,
+	}, nil
+}
+
+// matches checks if a token issuer belongs to this issuer
+func (k *issuerKeys) matches(issuer string) bool {
+	k.mu.RLock()
+	discovered := k.issuer
+	k.mu.RUnlock()
+
+	if discovered != "" && issuer == discovered {
+		return true
+	}
+	return strings.TrimSuffix(issuer, "/") == strings.TrimSuffix(k.configured, "/")
+}
+
+// allowsAlgorithm checks if the issuer advertises the given signing algorithm
+func (k *issuerKeys) allowsAlgorithm(alg string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, allowed := range k.algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure loads the keys if the background refresh has not yet, and rejects key
+// sets older than MaxStale. Claims are read before the signature is checked, so
+// fetches triggered here are rate-limited like refetches for an unknown kid.
+func (k *issuerKeys) ensure() error {
+	k.mu.RLock()
+	loaded := k.keySet != nil
+	lastFetch := k.lastFetch
+	k.mu.RUnlock()
+
+	if !loaded {
+		err := k.fetch(true)
+		if err == nil {
+			return nil
+		}
+		// A concurrent fetch may have loaded the keys in the meantime
+		if k.loaded() {
+			return nil
+		}
+		if errors.Is(err, errRefreshRateLimited) {
+			return fmt.Errorf("JWKS of issuer %s is not loaded yet: %w", k.configured, err)
+		}
+		return err
+	}
+
+	if k.refresh.MaxStale > 0 && time.Since(lastFetch) > k.refresh.MaxStale {
+		// Try once more before giving up on the cached keys; a concurrent
+		// request may also have refreshed them in the meantime
+		if err := k.fetch(true); err != nil {
+			k.mu.RLock()
+			lastFetch = k.lastFetch
+			k.mu.RUnlock()
+			if time.Since(lastFetch) > k.refresh.MaxStale {
+				return fmt.Errorf("JWKS is stale (last refreshed %s): %w", lastFetch.Format(time.RFC3339), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loaded reports whether a key set has been loaded
+func (k *issuerKeys) loaded() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keySet != nil
+}
+
+// lookupKey finds a key by ID in the current key set
+func (k *issuerKeys) lookupKey(kid string) (jwk.Key, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.keySet == nil {
+		return nil, false
+	}
+	return k.keySet.LookupKeyID(kid)
+}
+
+// fetch reads the discovery document and JWKS and replaces the cached metadata.
+// Forced fetches are skipped if another fetch was attempted within MinInterval.
+// On failure the previous metadata and key set are kept.
+func (k *issuerKeys) fetch(force bool) error {
+	k.fetchMutex.Lock()
+	defer k.fetchMutex.Unlock()
+
+	if force && time.Since(k.lastAttempt) < k.refresh.MinInterval {
+		return errRefreshRateLimited
+	}
+	k.lastAttempt = time.Now()
+
+	if k.jwksFile != "" {
+		return k.readFile()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	doc, err := k.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	jwksURL := doc.JWKSURI
+	if k.jwksURL != "" {
+		jwksURL = k.jwksURL
+	}
+
+	keySet, err := jwk.Fetch(ctx, jwksURL, jwk.WithHTTPClient(k.httpClient))
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %s: %w", jwksURL, err)
+	}
+
+	algorithms := make([]string, 0, len(doc.SigningAlgValues))
+	for _, alg := range doc.SigningAlgValues {
+		if _, ok := signingMethods[alg]; ok {
+			algorithms = append(algorithms, alg)
+		}
+	}
+	if len(doc.SigningAlgValues) == 0 {
+		algorithms = defaultAlgorithms
+	}
+	if len(algorithms) == 0 {
+		return fmt.Errorf("issuer %s advertises no supported signing algorithms: %s", k.configured, strings.Join(doc.SigningAlgValues, ", "))
+	}
+
+	k.mu.Lock()
+	k.issuer = doc.Issuer
+	k.algorithms = algorithms
+	k.keySet = keySet
+	k.lastFetch = time.Now()
+	k.mu.Unlock()
+
+	return nil
+}
+
+// readFile loads the key set from the local JWKS file; the file is re-read on
+// every refresh so rotated keys are picked up when the file is updated
+func (k *issuerKeys) readFile() error {
+	keySet, err := jwk.ReadFile(k.jwksFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file %s: %w", k.jwksFile, err)
+	}
+
+	k.mu.Lock()
+	k.issuer = k.configured
+	k.algorithms = k.fileAlgs
+	k.keySet = keySet
+	k.lastFetch = time.Now()
+	k.mu.Unlock()
+
+	return nil
+}
+
+// discover fetches and checks the OIDC discovery document of the issuer
+func (k *issuerKeys) discover(ctx context.Context) (*discoveryDocument, error) {
+	url := strings.TrimSuffix(k.configured, "/") + discoveryPath
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch discovery document %s: status %d", url, resp.StatusCode)
+	}
+
+	var doc discoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery document %s: %w", url, err)
+	}
+
+	if doc.JWKSURI == "" && k.jwksURL == "" {
+		return nil, fmt.Errorf("discovery document %s has no jwks_uri", url)
+	}
+	// The issuer in the document must identify the configured issuer (OIDC Discovery 4.3)
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(k.configured, "/") {
+		return nil, fmt.Errorf("discovery document %s is for issuer '%s', expected '%s'", url, doc.Issuer, k.configured)
+	}
+
+	return &doc, nil
+}
@@ -2,53 +2,147 @@ package jwt
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"math/rand"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
 )
 
-// Claims represents GitLab CI JWT claims
-type Claims struct {
-	jwt.RegisteredClaims
-	ProjectPath string `json:"project_path"`
-	RefPath     string `json:"ref_path"`
-	PipelineID  string `json:"pipeline_id"`
-	JobID       string `json:"job_id"`
+// Token is a verified OIDC token and the source that issued it
+type Token struct {
+	Source    Source
+	Claims    map[string]interface{}
+	ExpiresAt time.Time
 }
 
-// Validator validates GitLab OIDC JWTs
+// RefreshOptions controls how the validator keeps its JWKS up to date
+type RefreshOptions struct {
+	// Interval between background refreshes; each wait is jittered by up to 10%
+	Interval time.Duration
+	// MinInterval rate-limits fetches triggered by requests, i.e. by an unknown
+	// kid or by a token arriving before the first key set was loaded
+	MinInterval time.Duration
+	// MaxStale is how long the last good key set is served while refreshes fail;
+	// zero serves it indefinitely
+	MaxStale time.Duration
+}
+
+// Source is an OIDC token issuer (e.g. a GitLab instance) whose tokens the broker accepts
+type Source struct {
+	Name            string
+	Provider        string   // identity provider that interprets the claims, e.g. "gitlab"
+	PolicyNamespace string   // scopes policies and audit entries to this source
+	Audience        string   // expected aud claim
+	Issuers         []string // accepted iss values; discovery is read from each
+	JWKSUrl         string   // optional override for the discovered jwks_uri
+	JWKSFile        string   // optional local JWKS file; disables discovery
+	CAFile          string   // optional CA bundle for TLS to the issuer
+	Algorithms      []string // signing algorithms for JWKSFile (default RS256)
+}
+
+// source is a configured Source with the keys of its issuers
+type source struct {
+	Source
+	issuers []*issuerKeys
+}
+
+// Validator validates OIDC JWTs from one or more sources.
+// Signing keys and algorithms are read from each issuer's OIDC discovery document.
 type Validator struct {
-	audience    string
-	issuers     []string
-	jwksURL     string
-	keySet      jwk.Set
-	keySetMutex sync.RWMutex
-	lastFetch   time.Time
+	sources []*source
+	refresh RefreshOptions
+}
+
+// NewValidator creates a new JWT validator for the given sources
+func NewValidator(sources []Source, refresh RefreshOptions) (*Validator, error) {
+	v := &Validator{refresh: refresh}
+	for _, src := range sources {
+		s := &source{Source: src}
+		for _, issuer := range src.Issuers {
+			keys, err := newIssuerKeys(issuer, src, refresh)
+			if err != nil {
+				return nil, err
+			}
+			s.issuers = append(s.issuers, keys)
+		}
+		v.sources = append(v.sources, s)
+	}
+	return v, nil
+}
+
+// Run loads discovery metadata and JWKS right away and then refreshes them in the
+// background until the context is cancelled. Failed refreshes keep the last good
+// key set and are retried sooner.
+func (v *Validator) Run(ctx context.Context, logger *logging.Logger) {
+	logger.Info(fmt.Sprintf("JWKS refresher started (interval %s)", v.refresh.Interval))
+
+	for {
+		wait := v.refresh.Interval
+		for _, src := range v.sources {
+			for _, keys := range src.issuers {
+				if err := keys.fetch(false); err != nil {
+					logger.Error(fmt.Sprintf("Failed to refresh JWKS for source %s (issuer %s), serving last good key set", src.Name, keys.configured), err)
+					wait = v.refresh.MinInterval
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("JWKS refresher stopped")
+			return
+		case <-time.After(jitter(wait)):
+		}
+	}
 }
 
-// NewValidator creates a new JWT validator
-func NewValidator(audience string, issuers []string, jwksURL string) *Validator {
-	return &Validator{
-		audience: audience,
-		issuers:  issuers,
-		jwksURL:  jwksURL,
+// jitter spreads a duration by up to ±10% so replicas do not refresh in lockstep
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 10
+	if spread <= 0 {
+		return d
 	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
 }
 
-// ValidateToken validates a JWT token string
-func (v *Validator) ValidateToken(tokenString string) (*Claims, error) {
-	// Ensure JWKS is loaded
-	if err := v.refreshJWKS(); err != nil {
-		return nil, fmt.Errorf("failed to refresh JWKS: %w", err)
+// Sources returns the configured sources
+func (v *Validator) Sources() []Source {
+	sources := make([]Source, 0, len(v.sources))
+	for _, src := range v.sources {
+		sources = append(sources, src.Source)
 	}
+	return sources
+}
+
+// ValidateToken validates a JWT token string and returns its claims
+func (v *Validator) ValidateToken(tokenString string) (*Token, error) {
+	// Parse and validate token; claims are decoded before the key lookup,
+	// so issuer and audience select the source and the JWKS to use
+	var src *source
+	token, err := jwt.ParseWithClaims(tokenString, jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, fmt.Errorf("invalid token claims")
+		}
+
+		var keys *issuerKeys
+		var err error
+		src, keys, err = v.findSource(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ensure discovery metadata and JWKS are loaded and not too stale
+		if err := keys.ensure(); err != nil {
+			return nil, err
+		}
 
-	// Parse and validate token
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		// Validate signing method against the algorithms the issuer advertises
+		alg := token.Method.Alg()
+		if _, ok := signingMethods[alg]; !ok || !keys.allowsAlgorithm(alg) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
@@ -58,15 +152,23 @@ func (v *Validator) ValidateToken(tokenString string) (*Claims, error) {
 			return nil, fmt.Errorf("kid not found in token header")
 		}
 
-		// Find key in JWKS
-		v.keySetMutex.RLock()
-		defer v.keySetMutex.RUnlock()
-
-		key, found := v.keySet.LookupKeyID(kid)
+		// Find key in JWKS, refetching once if the issuer may have rotated its keys
+		key, found := keys.lookupKey(kid)
+		if !found {
+			if err := keys.fetch(true); err != nil && !errors.Is(err, errRefreshRateLimited) {
+				return nil, fmt.Errorf("failed to refresh JWKS for unknown kid: %w", err)
+			}
+			key, found = keys.lookupKey(kid)
+		}
 		if !found {
 			return nil, fmt.Errorf("key not found in JWKS")
 		}
 
+		// A key pinned to an algorithm must not be used with another one
+		if keyAlg := key.Algorithm().String(); keyAlg != "" && keyAlg != alg {
+			return nil, fmt.Errorf("key %s is for algorithm %s, token uses %s", kid, keyAlg, alg)
+		}
+
 		var rawKey interface{}
 		if err := key.Raw(&rawKey); err != nil {
 			return nil, fmt.Errorf("failed to get raw key: %w", err)
@@ -79,74 +181,47 @@ func (v *Validator) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
 
-	claims, ok := token.Claims.(*Claims)
+	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
-	// Validate issuer
-	if !v.isValidIssuer(claims.Issuer) {
-		return nil, fmt.Errorf("invalid issuer: %s", claims.Issuer)
-	}
-
-	// Validate audience
-	found := false
-	for _, aud := range claims.Audience {
-		if aud == v.audience {
-			found = true
-			break
-		}
-	}
-	if !found {
-		return nil, fmt.Errorf("invalid audience")
-	}
-
 	// Validate expiration
-	if claims.ExpiresAt == nil || claims.ExpiresAt.Before(time.Now()) {
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil || expiresAt.Before(time.Now()) {
 		return nil, fmt.Errorf("token expired")
 	}
 
-	return claims, nil
+	return &Token{
+		Source:    src.Source,
+		Claims:    claims,
+		ExpiresAt: expiresAt.Time,
+	}, nil
 }
 
-// refreshJWKS fetches the JWKS from GitLab if needed
-func (v *Validator) refreshJWKS() error {
-	v.keySetMutex.RLock()
-	needsRefresh := v.keySet == nil || time.Since(v.lastFetch) > 1*time.Hour
-	v.keySetMutex.RUnlock()
-
-	if !needsRefresh {
-		return nil
-	}
-
-	v.keySetMutex.Lock()
-	defer v.keySetMutex.Unlock()
-
-	// Double-check after acquiring write lock
-	if v.keySet != nil && time.Since(v.lastFetch) <= 1*time.Hour {
-		return nil
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	keySet, err := jwk.Fetch(ctx, v.jwksURL)
-	if err != nil {
-		return fmt.Errorf("failed to fetch JWKS: %w", err)
+// findSource returns the source and issuer a token belongs to.
+// Sources may share an issuer, in which case the audience decides.
+func (v *Validator) findSource(claims jwt.MapClaims) (*source, *issuerKeys, error) {
+	issuer, _ := claims.GetIssuer()
+	audience, _ := claims.GetAudience()
+
+	issuerKnown := false
+	for _, src := range v.sources {
+		for _, keys := range src.issuers {
+			if !keys.matches(issuer) {
+				continue
+			}
+			issuerKnown = true
+			for _, aud := range audience {
+				if aud == src.Audience {
+					return src, keys, nil
+				}
+			}
+		}
 	}
 
-	v.keySet = keySet
-	v.lastFetch = time.Now()
-
-	return nil
-}
-
-// isValidIssuer checks if the issuer is in the allowed list
-func (v *Validator) isValidIssuer(issuer string) bool {
-	for _, allowed := range v.issuers {
-		if allowed == issuer {
-			return true
-		}
+	if !issuerKnown {
+		return nil, nil, fmt.Errorf("invalid issuer: %s", issuer)
 	}
-	return false
+	return nil, nil, fmt.Errorf("invalid audience")
 }
@@ -20,19 +20,24 @@ type Logger struct {
 
 // LogEntry represents a structured log entry
 type LogEntry struct {
-	Timestamp      time.Time              `json:"timestamp"`
-	Level          string                 `json:"level"`
-	Message        string                 `json:"message"`
-	GitLabProject  string                 `json:"gitlab_project,omitempty"`
-	HarborProject  string                 `json:"harbor_project,omitempty"`
-	Permission     string                 `json:"permission,omitempty"`
-	RobotID        int64                  `json:"robot_id,omitempty"`
-	RobotName      string                 `json:"robot_name,omitempty"`
-	ExpiresAt      string                 `json:"expires_at,omitempty"`
-	PipelineID     string                 `json:"pipeline_id,omitempty"`
-	JobID          string                 `json:"job_id,omitempty"`
-	Error          string                 `json:"error,omitempty"`
-	AdditionalData map[string]interface{} `json:"additional_data,omitempty"`
+	Timestamp       time.Time              `json:"timestamp"`
+	Level           string                 `json:"level"`
+	Message         string                 `json:"message"`
+	IdentitySource  string                 `json:"identity_source,omitempty"`
+	PolicyNamespace string                 `json:"policy_namespace,omitempty"`
+	GitLabProject   string                 `json:"gitlab_project,omitempty"`
+	HarborProject   string                 `json:"harbor_project,omitempty"`
+	Permission      string                 `json:"permission,omitempty"`
+	RobotID         int64                  `json:"robot_id,omitempty"`
+	RobotName       string                 `json:"robot_name,omitempty"`
+	ExpiresAt       string                 `json:"expires_at,omitempty"`
+	TTLMinutes      int                    `json:"ttl_minutes,omitempty"`
+	PipelineID      string                 `json:"pipeline_id,omitempty"`
+	JobID           string                 `json:"job_id,omitempty"`
+	RobotScope      string                 `json:"robot_scope,omitempty"`
+	Registry        string                 `json:"registry,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+	AdditionalData  map[string]interface{} `json:"additional_data,omitempty"`
 }
 
 // NewLogger creates a new structured logger
@@ -65,58 +70,183 @@ func (l *Logger) Error(message string, err error) {
 }
 
 // AuditTokenIssued logs when a token is issued
-func (l *Logger) AuditTokenIssued(gitlabProject, harborProject, permission string, robotID int64, robotName string, expiresAt time.Time, pipelineID, jobID string) {
+func (l *Logger) AuditTokenIssued(source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName string, expiresAt time.Time, ttlMinutes int, pipelineID, jobID, robotScope, registry string) {
+	l.auditCredential("Token issued", "success", source, policyNamespace, gitlabProject, harborProject, permission, robotID, robotName, expiresAt, ttlMinutes, pipelineID, jobID, robotScope, registry)
+}
+
+// AuditTokenRotated logs when a retried request gets a new secret for the robot already issued to the job
+func (l *Logger) AuditTokenRotated(source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName string, expiresAt time.Time, ttlMinutes int, pipelineID, jobID, robotScope, registry string) {
+	l.auditCredential("Token rotated", "rotated", source, policyNamespace, gitlabProject, harborProject, permission, robotID, robotName, expiresAt, ttlMinutes, pipelineID, jobID, robotScope, registry)
+}
+
+// auditCredential logs a credential handed out to a CI job with the given status
+func (l *Logger) auditCredential(message, status, source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName string, expiresAt time.Time, ttlMinutes int, pipelineID, jobID, robotScope, registry string) {
 	entry := LogEntry{
-		GitLabProject: gitlabProject,
-		HarborProject: harborProject,
-		Permission:    permission,
-		RobotID:       robotID,
-		RobotName:     robotName,
-		ExpiresAt:     expiresAt.Format(time.RFC3339),
-		PipelineID:    pipelineID,
-		JobID:         jobID,
+		IdentitySource:  source,
+		PolicyNamespace: policyNamespace,
+		GitLabProject:   gitlabProject,
+		HarborProject:   harborProject,
+		Permission:      permission,
+		RobotID:         robotID,
+		RobotName:       robotName,
+		ExpiresAt:       expiresAt.Format(time.RFC3339),
+		TTLMinutes:      ttlMinutes,
+		PipelineID:      pipelineID,
+		JobID:           jobID,
+		RobotScope:      robotScope,
+		Registry:        registry,
 	}
-	l.log("AUDIT", "Token issued", entry)
+	l.log("AUDIT", message, entry)
 
 	// If database store is available, persist to database
 	if l.accessLogStore != nil {
 		dbLog := map[string]interface{}{
-			"timestamp":      time.Now(),
-			"gitlab_project": gitlabProject,
-			"harbor_project": harborProject,
-			"permission":     permission,
-			"robot_id":       robotID,
-			"robot_name":     robotName,
-			"expires_at":     expiresAt,
-			"pipeline_id":    pipelineID,
-			"job_id":         jobID,
-			"status":         "success",
+			"timestamp":        time.Now(),
+			"identity_source":  source,
+			"policy_namespace": policyNamespace,
+			"gitlab_project":   gitlabProject,
+			"harbor_project":   harborProject,
+			"permission":       permission,
+			"robot_id":         robotID,
+			"robot_name":       robotName,
+			"expires_at":       expiresAt,
+			"ttl_minutes":      ttlMinutes,
+			"pipeline_id":      pipelineID,
+			"job_id":           jobID,
+			"robot_scope":      robotScope,
+			"registry":         registry,
+			"status":           status,
 		}
-		_ = l.accessLogStore.LogAccess(dbLog)
+		l.persist(dbLog)
 	}
 }
 
 // AuditRequestDenied logs when a request is denied
-func (l *Logger) AuditRequestDenied(gitlabProject, harborProject, permission, reason string) {
+func (l *Logger) AuditRequestDenied(source, policyNamespace, gitlabProject, harborProject, permission, reason string) {
 	entry := LogEntry{
-		GitLabProject: gitlabProject,
-		HarborProject: harborProject,
-		Permission:    permission,
-		Error:         reason,
+		IdentitySource:  source,
+		PolicyNamespace: policyNamespace,
+		GitLabProject:   gitlabProject,
+		HarborProject:   harborProject,
+		Permission:      permission,
+		Error:           reason,
 	}
 	l.log("AUDIT", "Request denied", entry)
 
 	// If database store is available, persist to database
 	if l.accessLogStore != nil {
 		dbLog := map[string]interface{}{
-			"timestamp":       time.Now(),
-			"gitlab_project":  gitlabProject,
-			"harbor_project":  harborProject,
-			"permission":      permission,
-			"status":          "denied",
-			"error_message":   reason,
+			"timestamp":        time.Now(),
+			"identity_source":  source,
+			"policy_namespace": policyNamespace,
+			"gitlab_project":   gitlabProject,
+			"harbor_project":   harborProject,
+			"permission":       permission,
+			"status":           "denied",
+			"error_message":    reason,
 		}
-		_ = l.accessLogStore.LogAccess(dbLog)
+		l.persist(dbLog)
+	}
+}
+
+// AuditTokenReplayed logs when a CI token that was already used is presented again
+func (l *Logger) AuditTokenReplayed(source, policyNamespace, gitlabProject, harborProject, permission, reason, pipelineID, jobID string) {
+	entry := LogEntry{
+		IdentitySource:  source,
+		PolicyNamespace: policyNamespace,
+		GitLabProject:   gitlabProject,
+		HarborProject:   harborProject,
+		Permission:      permission,
+		PipelineID:      pipelineID,
+		JobID:           jobID,
+		Error:           reason,
+	}
+	l.log("AUDIT", "Token replayed", entry)
+
+	// If database store is available, persist to database
+	if l.accessLogStore != nil {
+		dbLog := map[string]interface{}{
+			"timestamp":        time.Now(),
+			"identity_source":  source,
+			"policy_namespace": policyNamespace,
+			"gitlab_project":   gitlabProject,
+			"harbor_project":   harborProject,
+			"permission":       permission,
+			"status":           "replayed",
+			"error_message":    reason,
+		}
+		if pipelineID != "" {
+			dbLog["pipeline_id"] = pipelineID
+		}
+		if jobID != "" {
+			dbLog["job_id"] = jobID
+		}
+		l.persist(dbLog)
+	}
+}
+
+// AuditRobotDeleted logs when the reaper deletes a robot account from its registry
+func (l *Logger) AuditRobotDeleted(source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName, reason, pipelineID, jobID, registry string) {
+	l.auditRobotRemoved("Robot deleted", "deleted", source, policyNamespace, gitlabProject, harborProject, permission, robotID, robotName, reason, pipelineID, jobID, registry)
+}
+
+// AuditRobotRevoked logs when a robot account is revoked on request of a CI job
+func (l *Logger) AuditRobotRevoked(source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName, reason, pipelineID, jobID, registry string) {
+	l.auditRobotRemoved("Robot revoked", "revoked", source, policyNamespace, gitlabProject, harborProject, permission, robotID, robotName, reason, pipelineID, jobID, registry)
+}
+
+// AuditRobotReclaimed logs when a pool robot is returned to the pool after its lease expired
+func (l *Logger) AuditRobotReclaimed(source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName, reason, pipelineID, jobID, registry string) {
+	l.auditRobotRemoved("Robot reclaimed", "reclaimed", source, policyNamespace, gitlabProject, harborProject, permission, robotID, robotName, reason, pipelineID, jobID, registry)
+}
+
+// auditRobotRemoved logs the removal of a robot account with the given status
+func (l *Logger) auditRobotRemoved(message, status, source, policyNamespace, gitlabProject, harborProject, permission string, robotID int64, robotName, reason, pipelineID, jobID, registry string) {
+	entry := LogEntry{
+		IdentitySource:  source,
+		PolicyNamespace: policyNamespace,
+		GitLabProject:   gitlabProject,
+		HarborProject:   harborProject,
+		Permission:      permission,
+		RobotID:         robotID,
+		RobotName:       robotName,
+		PipelineID:      pipelineID,
+		JobID:           jobID,
+		Registry:        registry,
+		Error:           reason,
+	}
+	l.log("AUDIT", message, entry)
+
+	// If database store is available, persist to database
+	if l.accessLogStore != nil {
+		dbLog := map[string]interface{}{
+			"timestamp":        time.Now(),
+			"identity_source":  source,
+			"policy_namespace": policyNamespace,
+			"gitlab_project":   gitlabProject,
+			"harbor_project":   harborProject,
+			"permission":       permission,
+			"robot_id":         robotID,
+			"robot_name":       robotName,
+			"registry":         registry,
+			"status":           status,
+			"error_message":    reason,
+		}
+		if pipelineID != "" {
+			dbLog["pipeline_id"] = pipelineID
+		}
+		if jobID != "" {
+			dbLog["job_id"] = jobID
+		}
+		l.persist(dbLog)
+	}
+}
+
+// persist writes an audit entry to the access log store. A failed write is
+// logged, as the reaper relies on the access log to know which robots are gone.
+func (l *Logger) persist(dbLog map[string]interface{}) {
+	if err := l.accessLogStore.LogAccess(dbLog); err != nil {
+		l.log("ERROR", "Failed to write access log", LogEntry{Error: err.Error(), AdditionalData: dbLog})
 	}
 }
 
@@ -0,0 +1,151 @@
+package pattern
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// TemplateVariables lists the variables that can be used in Harbor project templates
+var TemplateVariables = []string{"namespace", "project", "group"}
+
+// templateVarPattern matches ${name} placeholders in Harbor project templates
+var templateVarPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// MatchProject checks if a GitLab project path matches a project pattern.
+//
+// Patterns are matched segment by segment on "/":
+//   - "group/project" matches exactly that project
+//   - "*" matches within a single segment, e.g. "team-a/*-service"
+//   - "**" matches any number of segments, e.g. "platform/**" for a whole group
+func MatchProject(pattern, projectPath string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(projectPath, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, expanding "**"
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		matched, err := path.Match(pattern[0], segments[0])
+		if err != nil || !matched {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+// ValidateProject checks if a GitLab project pattern is well-formed
+func ValidateProject(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "" {
+			return fmt.Errorf("invalid project pattern '%s': empty path segment", pattern)
+		}
+		if segment == "**" {
+			continue
+		}
+		if strings.Contains(segment, "**") {
+			return fmt.Errorf("invalid project pattern '%s': '**' must be a whole path segment", pattern)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid project pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Specificity ranks a project pattern; higher values are more specific.
+// Exact paths rank above single-segment wildcards, which rank above "**".
+// Within the same class, patterns with more literal characters win; path
+// separators do not count, so a deeper pattern is not more specific by itself.
+func Specificity(pattern string) (class int, literals int) {
+	switch {
+	case strings.Contains(pattern, "**"):
+		class = 0
+	case strings.ContainsAny(pattern, "*?["):
+		class = 1
+	default:
+		class = 2
+	}
+
+	for _, ch := range pattern {
+		switch ch {
+		case '*', '?', '[', ']', '/':
+		default:
+			literals++
+		}
+	}
+
+	return class, literals
+}
+
+// MoreSpecific reports whether project pattern a is more specific than b
+func MoreSpecific(a, b string) bool {
+	classA, literalsA := Specificity(a)
+	classB, literalsB := Specificity(b)
+	if classA != classB {
+		return classA > classB
+	}
+	return literalsA > literalsB
+}
+
+// ExpandTemplate replaces ${name} placeholders in a Harbor project template
+func ExpandTemplate(template string, vars map[string]string) string {
+	return templateVarPattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := templateVarPattern.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// ValidateTemplate checks that a Harbor project template only uses known variables
+func ValidateTemplate(template string) error {
+	for _, match := range templateVarPattern.FindAllStringSubmatch(template, -1) {
+		known := false
+		for _, name := range TemplateVariables {
+			if match[1] == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown template variable '${%s}' in '%s'", match[1], template)
+		}
+	}
+	return nil
+}
+
+// ProjectVariables derives template variables from a GitLab project path.
+// namespace is the full parent path, group the top-level group and project the last segment.
+func ProjectVariables(namespacePath, projectPath string) map[string]string {
+	if namespacePath == "" {
+		namespacePath = path.Dir(projectPath)
+	}
+
+	group := namespacePath
+	if i := strings.Index(group, "/"); i >= 0 {
+		group = group[:i]
+	}
+
+	return map[string]string{
+		"namespace": namespacePath,
+		"project":   path.Base(projectPath),
+		"group":     group,
+	}
+}
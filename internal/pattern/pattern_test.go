@@ -0,0 +1,165 @@
+package pattern
+
+import "testing"
+
+func TestMatchProject(t *testing.T) {
+	tests := []struct {
+		pattern string
+		project string
+		want    bool
+	}{
+		{"team-a/app", "team-a/app", true},
+		{"team-a/app", "team-a/app2", false},
+		{"team-a/app", "team-a/sub/app", false},
+
+		// "*" stays within one segment
+		{"team-a/*", "team-a/app", true},
+		{"team-a/*", "team-a/sub/app", false},
+		{"team-a/*-service", "team-a/billing-service", true},
+		{"team-a/*-service", "team-a/billing", false},
+		{"*/app", "team-a/app", true},
+
+		// "?" matches exactly one character
+		{"team-a/app?", "team-a/app1", true},
+		{"team-a/app?", "team-a/app", false},
+		{"team-a/app?", "team-a/app12", false},
+
+		// "**" matches any number of segments
+		{"platform/**", "platform/api", true},
+		{"platform/**", "platform/backend/api", true},
+		{"platform/**/api", "platform/api", true},
+		{"platform/**/api", "platform/backend/core/api", true},
+		{"platform/**/api", "platform/backend/web", false},
+		{"**", "any/project/path", true},
+
+		// Group prefixes only match whole segments
+		{"platform/**", "platform-tools/api", false},
+		{"platform/**", "other/platform/api", false},
+		{"platform/*", "platform-tools/api", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchProject(tt.pattern, tt.project); got != tt.want {
+			t.Errorf("MatchProject(%q, %q) = %v, want %v", tt.pattern, tt.project, got, tt.want)
+		}
+	}
+}
+
+func TestValidateProject(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"team-a/app", true},
+		{"team-a/*-service", true},
+		{"platform/**", true},
+		{"platform/**/api", true},
+		{"team-a//app", false},
+		{"platform/**api", false},
+		{"team-a/[app", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateProject(tt.pattern)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateProject(%q) = %v, want valid=%v", tt.pattern, err, tt.valid)
+		}
+	}
+}
+
+func TestSpecificity(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		class    int
+		literals int
+	}{
+		{"team-a/app", 2, 9},
+		{"team-a/*", 1, 6},
+		{"team-a/app?", 1, 9},
+		{"platform/**", 0, 8},
+		{"a/b/c/d", 2, 4},
+	}
+
+	for _, tt := range tests {
+		class, literals := Specificity(tt.pattern)
+		if class != tt.class || literals != tt.literals {
+			t.Errorf("Specificity(%q) = (%d, %d), want (%d, %d)", tt.pattern, class, literals, tt.class, tt.literals)
+		}
+	}
+}
+
+func TestMoreSpecific(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"team-a/app", "team-a/*", true},
+		{"team-a/*", "team-a/**", true},
+		{"team-a/*", "team-a/app", false},
+		{"team-a/*-service", "team-a/*", true},
+		{"platform/backend/**", "platform/**", true},
+		// Depth alone does not make a pattern more specific
+		{"ab/*/*", "abc/*", false},
+		{"abc/*", "ab/*/*", true},
+		{"a/b/**", "ab/**", false},
+		{"ab/**", "a/b/**", false},
+	}
+
+	for _, tt := range tests {
+		if got := MoreSpecific(tt.a, tt.b); got != tt.want {
+			t.Errorf("MoreSpecific(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	vars := ProjectVariables("platform/backend", "platform/backend/api")
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"library", "library"},
+		{"${group}-images", "platform-images"},
+		{"${project}", "api"},
+		{"${namespace}", "platform/backend"},
+		{"${group}-${project}", "platform-api"},
+		{"${unknown}-images", "${unknown}-images"},
+	}
+
+	for _, tt := range tests {
+		if got := ExpandTemplate(tt.template, vars); got != tt.want {
+			t.Errorf("ExpandTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestProjectVariables(t *testing.T) {
+	tests := []struct {
+		namespace string
+		project   string
+		want      map[string]string
+	}{
+		{"", "team-a/app", map[string]string{"namespace": "team-a", "project": "app", "group": "team-a"}},
+		{"", "platform/backend/api", map[string]string{"namespace": "platform/backend", "project": "api", "group": "platform"}},
+		{"platform/backend", "platform/backend/api", map[string]string{"namespace": "platform/backend", "project": "api", "group": "platform"}},
+	}
+
+	for _, tt := range tests {
+		got := ProjectVariables(tt.namespace, tt.project)
+		for name, want := range tt.want {
+			if got[name] != want {
+				t.Errorf("ProjectVariables(%q, %q)[%s] = %q, want %q", tt.namespace, tt.project, name, got[name], want)
+			}
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	if err := ValidateTemplate("${group}-${project}"); err != nil {
+		t.Errorf("ValidateTemplate with known variables: %v", err)
+	}
+	if err := ValidateTemplate("${team}-images"); err == nil {
+		t.Error("ValidateTemplate with unknown variable: expected error")
+	}
+}
@@ -1,84 +1,445 @@
 package policy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"path"
+	"sort"
 
 	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/config"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/identity"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/pattern"
 )
 
 // PolicyStore interface for policy storage backends
 type PolicyStore interface {
-	GetPolicyByGitLabProject(gitlabProject string) (PolicyRule, error)
+	// GetPoliciesByGitLabProject returns all rules of a policy namespace that may
+	// apply to a GitLab project. A project can have any number of rules; the result
+	// may include pattern rules that do not match, as the engine performs the final matching.
+	GetPoliciesByGitLabProject(ctx context.Context, policyNamespace, gitlabProject string) ([]PolicyRule, error)
 }
 
-// PolicyRule represents a policy rule (compatible with database)
+// Rule effects
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Handling of replayed CI tokens
+const (
+	ReplayReject      = "reject"
+	ReplayDeduplicate = "deduplicate"
+)
+
+// Robot account sharing
+const (
+	RobotScopeJob      = "job"
+	RobotScopePipeline = "pipeline"
+)
+
+// PolicyRule represents a policy rule (compatible with database).
+// GitLabProject may be an exact path or a pattern such as "platform/**",
+// and HarborProjects may contain templates such as "${namespace}".
+// For deny rules, AllowedPermissions lists the denied permissions; empty denies all.
+// A deny rule also denies other permissions that grant what only the denied ones grant.
+// PolicyNamespace scopes the rule to the identity source with that namespace,
+// and Registry binds its Harbor projects to a registry (empty for the harbor section).
 type PolicyRule struct {
-	GitLabProject      string
-	HarborProjects     []string
-	AllowedPermissions []string
+	Name               string            `json:"name"`
+	Effect             string            `json:"effect,omitempty"`
+	PolicyNamespace    string            `json:"policy_namespace,omitempty"`
+	GitLabProject      string            `json:"gitlab_project"`
+	HarborProjects     []string          `json:"harbor_projects"`
+	AllowedPermissions []string          `json:"allowed_permissions"`
+	Conditions         map[string]string `json:"conditions,omitempty"`
+	MaxTTLMinutes      int               `json:"max_ttl_minutes,omitempty"`
+	DefaultTTLMinutes  int               `json:"default_ttl_minutes,omitempty"`
+	OnReplay           string            `json:"on_replay,omitempty"`
+	RobotScope         string            `json:"robot_scope,omitempty"`
+	Registry           string            `json:"registry,omitempty"`
 }
 
 // Engine enforces authorization policies
 type Engine struct {
-	rules       []config.PolicyRule
+	rules       []PolicyRule
 	policyStore PolicyStore
+	profiles    *Profiles // resolves permissions for deny rules
 }
 
 // NewEngine creates a new policy engine with config-based rules
-func NewEngine(rules []config.PolicyRule) *Engine {
+func NewEngine(rules []config.PolicyRule, profiles *Profiles) *Engine {
+	converted := make([]PolicyRule, 0, len(rules))
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("policy[%d]", i)
+		}
+		converted = append(converted, PolicyRule{
+			Name:               name,
+			Effect:             rule.Effect,
+			PolicyNamespace:    rule.PolicyNamespace,
+			GitLabProject:      rule.GitLabProject,
+			HarborProjects:     rule.HarborProjects,
+			AllowedPermissions: rule.AllowedPerms,
+			Conditions:         rule.Conditions,
+			MaxTTLMinutes:      rule.MaxTTL,
+			DefaultTTLMinutes:  rule.DefaultTTL,
+			OnReplay:           rule.OnReplay,
+			RobotScope:         rule.RobotScope,
+			Registry:           rule.Registry,
+		})
+	}
+
 	return &Engine{
-		rules: rules,
+		rules:    converted,
+		profiles: profiles,
 	}
 }
 
 // NewEngineWithStore creates a new policy engine with database-backed storage
-func NewEngineWithStore(store PolicyStore) *Engine {
+func NewEngineWithStore(store PolicyStore, profiles *Profiles) *Engine {
 	return &Engine{
 		policyStore: store,
+		profiles:    profiles,
 	}
 }
 
-// AuthorizeRequest checks if a request is authorized
-func (e *Engine) AuthorizeRequest(gitlabProject, harborProject, permission string) error {
-	// If using database store, query from database
-	if e.policyStore != nil {
-		rule, err := e.policyStore.GetPolicyByGitLabProject(gitlabProject)
-		if err != nil {
-			return fmt.Errorf("failed to fetch policy: %w", err)
+// Decision is the outcome of evaluating a request against the policies
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the rule that decided the request: the granting allow rule, the
+	// matching deny rule, or the allow rule that lacks the requested permission
+	Rule *PolicyRule `json:"rule,omitempty"`
+	// NearMiss is the closest rule that did not apply when no rule decided
+	NearMiss *PolicyRule `json:"near_miss,omitempty"`
+	Reason   string      `json:"reason"`
+}
+
+// AuthorizeRequest checks if a request is authorized and returns the granting rule
+func (e *Engine) AuthorizeRequest(ctx context.Context, id *identity.Identity, registry, harborProject, permission string) (*PolicyRule, error) {
+	decision, err := e.Evaluate(ctx, id, registry, harborProject, permission)
+	if err != nil {
+		return nil, err
+	}
+	if !decision.Allowed {
+		return nil, errors.New(decision.Reason)
+	}
+	return decision.Rule, nil
+}
+
+// DeduplicatesReplays reports whether a replayed token may replace the credentials
+// previously issued to its job instead of being rejected
+func (r *PolicyRule) DeduplicatesReplays() bool {
+	return r.OnReplay == ReplayDeduplicate
+}
+
+// SharesPipelineRobot reports whether all jobs of a pipeline share one robot
+// per Harbor project instead of getting a robot each
+func (r *PolicyRule) SharesPipelineRobot() bool {
+	return r.RobotScope == RobotScopePipeline
+}
+
+// TTLMinutes returns the credential TTL granted by the rule.
+// The requested TTL (or the rule default, or fallback if neither is set)
+// is clamped to the rule's maximum.
+func (r *PolicyRule) TTLMinutes(requested, fallback int) int {
+	ttl := requested
+	if ttl == 0 {
+		ttl = r.DefaultTTLMinutes
+	}
+	if ttl == 0 {
+		ttl = fallback
+	}
+	if r.MaxTTLMinutes > 0 && ttl > r.MaxTTLMinutes {
+		ttl = r.MaxTTLMinutes
+	}
+	return ttl
+}
+
+// Evaluate evaluates a request for a project in a registry against the policies
+// and explains the decision. Only rules bound to the registry are considered.
+// An error is only returned if the policies or permission profiles cannot be loaded.
+//
+// Precedence:
+//  1. A matching deny rule always denies, regardless of specificity. It matches
+//     a permission it lists, and any permission that grants a Harbor action
+//     only the listed permissions grant (see deniedAccess). A deny rule whose
+//     conditions cannot be evaluated is treated as matching, so it fails closed.
+//  2. Otherwise, allow rules whose gitlab_project pattern matches the project
+//     are considered most specific first (exact path, then single-segment
+//     wildcards, then "**", then by number of literal characters, then
+//     declaration order). The first rule that covers the Harbor project and
+//     whose conditions hold decides whether the permission is granted.
+//  3. If no rule applies, the request is denied.
+func (e *Engine) Evaluate(ctx context.Context, id *identity.Identity, registry, harborProject, permission string) (*Decision, error) {
+	gitlabProject := id.Repository
+
+	rules, err := e.loadRules(ctx, id.PolicyNamespace, gitlabProject)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := pattern.ProjectVariables(id.Namespace, gitlabProject)
+	matched := matchingRules(rules, gitlabProject, registry)
+
+	// Explicit deny rules override any allow
+	var requested []harbor.Access
+	resolved := false
+	for i, rule := range matched {
+		if rule.Effect != EffectDeny {
+			continue
+		}
+		if !allowsHarborProject(rule.HarborProjects, harborProject, vars) {
+			continue
+		}
+		var invalid *invalidConditionError
+		conditionErr := checkConditions(rule.Conditions, id)
+		if conditionErr != nil && !errors.As(conditionErr, &invalid) {
+			continue
+		}
+		if len(rule.AllowedPermissions) > 0 && !contains(rule.AllowedPermissions, permission) {
+			// Match on what the permission grants, so a custom profile cannot bypass the rule
+			if !resolved {
+				requested, err = e.resolve(ctx, permission)
+				if err != nil {
+					return nil, err
+				}
+				resolved = true
+			}
+			denied, err := e.deniedAccess(ctx, rule.AllowedPermissions)
+			if err != nil {
+				return nil, err
+			}
+			if !overlaps(requested, denied) {
+				continue
+			}
+		}
+		reason := fmt.Sprintf("denied by deny rule %s (gitlab_project '%s')", rule.Name, rule.GitLabProject)
+		if invalid != nil {
+			reason += fmt.Sprintf(", whose conditions cannot be evaluated: %v", invalid)
+		}
+		return &Decision{
+			Rule:   &matched[i],
+			Reason: reason,
+		}, nil
+	}
+
+	var nearMiss *PolicyRule
+	var conditionErr error
+	for i, rule := range matched {
+		if rule.Effect == EffectDeny {
+			continue
 		}
 
 		// Check if Harbor project is allowed
-		if !contains(rule.HarborProjects, harborProject) {
-			return fmt.Errorf("no policy found for GitLab project '%s' and Harbor project '%s'", gitlabProject, harborProject)
+		if !allowsHarborProject(rule.HarborProjects, harborProject, vars) {
+			if nearMiss == nil {
+				nearMiss = &matched[i]
+			}
+			continue
+		}
+
+		// Check if claim conditions are satisfied; a less specific rule may still match
+		if err := checkConditions(rule.Conditions, id); err != nil {
+			if conditionErr == nil {
+				conditionErr = err
+				nearMiss = &matched[i]
+			}
+			continue
 		}
 
 		// Check if permission is allowed
 		if !contains(rule.AllowedPermissions, permission) {
-			return fmt.Errorf("permission '%s' not allowed for this project", permission)
+			return &Decision{
+				Rule:   &matched[i],
+				Reason: fmt.Sprintf("permission '%s' not allowed for this project", permission),
+			}, nil
 		}
 
-		return nil
+		// Authorization successful
+		return &Decision{
+			Allowed: true,
+			Rule:    &matched[i],
+			Reason:  fmt.Sprintf("allowed by rule %s (gitlab_project '%s')", rule.Name, rule.GitLabProject),
+		}, nil
 	}
 
-	// Otherwise, use config-based rules
-	for _, rule := range e.rules {
-		if rule.GitLabProject == gitlabProject {
-			// Check if Harbor project is allowed
-			if !contains(rule.HarborProjects, harborProject) {
-				continue
+	if conditionErr != nil {
+		return &Decision{NearMiss: nearMiss, Reason: conditionErr.Error()}, nil
+	}
+
+	reason := fmt.Sprintf("no policy found for GitLab project '%s' and Harbor project '%s'", gitlabProject, harborProject)
+	if registry != "" {
+		reason += fmt.Sprintf(" in registry '%s'", registry)
+	}
+	return &Decision{
+		NearMiss: nearMiss,
+		Reason:   reason,
+	}, nil
+}
+
+// loadRules returns the candidate rules of a policy namespace from the policy store,
+// or from the config-based rules
+func (e *Engine) loadRules(ctx context.Context, policyNamespace, gitlabProject string) ([]PolicyRule, error) {
+	if e.policyStore == nil {
+		var rules []PolicyRule
+		for _, rule := range e.rules {
+			if rule.PolicyNamespace == policyNamespace {
+				rules = append(rules, rule)
 			}
+		}
+		return rules, nil
+	}
+
+	rules, err := e.policyStore.GetPoliciesByGitLabProject(ctx, policyNamespace, gitlabProject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch policy: %w", err)
+	}
+	return rules, nil
+}
+
+// resolve returns the Harbor access actions of a permission, or nil if it is unknown
+func (e *Engine) resolve(ctx context.Context, permission string) ([]harbor.Access, error) {
+	if e.profiles == nil {
+		return nil, nil
+	}
+	access, err := e.profiles.Resolve(ctx, permission)
+	if errors.Is(err, ErrUnknownPermission) {
+		return nil, nil
+	}
+	return access, err
+}
+
+// deniedAccess returns the Harbor access actions a deny rule denies: those granted
+// by the listed permissions, except the ones also granted by a built-in profile
+// that is not listed and grants strictly less than a listed permission. Denying
+// "write" therefore denies repository:push, e.g. through a custom profile, but
+// not the repository:pull that "read" grants.
+func (e *Engine) deniedAccess(ctx context.Context, permissions []string) (map[harbor.Access]bool, error) {
+	listed := make([][]harbor.Access, 0, len(permissions))
+	denied := make(map[harbor.Access]bool)
+	for _, permission := range permissions {
+		access, err := e.resolve(ctx, permission)
+		if err != nil {
+			return nil, err
+		}
+		listed = append(listed, access)
+		for _, action := range access {
+			denied[action] = true
+		}
+	}
 
-			// Check if permission is allowed
-			if !contains(rule.AllowedPerms, permission) {
-				return fmt.Errorf("permission '%s' not allowed for this project", permission)
+	for name, access := range builtinProfiles {
+		if contains(permissions, name) {
+			continue
+		}
+		for _, other := range listed {
+			if strictSubset(access, other) {
+				for _, action := range access {
+					delete(denied, action)
+				}
+				break
 			}
+		}
+	}
 
-			// Authorization successful
-			return nil
+	return denied, nil
+}
+
+// strictSubset reports whether every action of a is in b and b has more actions
+func strictSubset(a, b []harbor.Access) bool {
+	set := make(map[harbor.Access]bool, len(b))
+	for _, action := range b {
+		set[action] = true
+	}
+	for _, action := range a {
+		if !set[action] {
+			return false
 		}
+		delete(set, action)
 	}
+	return len(set) > 0
+}
 
-	return fmt.Errorf("no policy found for GitLab project '%s' and Harbor project '%s'", gitlabProject, harborProject)
+// overlaps reports whether any of the actions is denied
+func overlaps(access []harbor.Access, denied map[harbor.Access]bool) bool {
+	for _, action := range access {
+		if denied[action] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingRules returns the rules of a registry matching a GitLab project, most specific first
+func matchingRules(rules []PolicyRule, gitlabProject, registry string) []PolicyRule {
+	var matched []PolicyRule
+	for _, rule := range rules {
+		if rule.Registry == registry && pattern.MatchProject(rule.GitLabProject, gitlabProject) {
+			matched = append(matched, rule)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return pattern.MoreSpecific(matched[i].GitLabProject, matched[j].GitLabProject)
+	})
+
+	return matched
+}
+
+// allowsHarborProject checks if any (templated) Harbor project entry equals harborProject
+func allowsHarborProject(harborProjects []string, harborProject string, vars map[string]string) bool {
+	for _, entry := range harborProjects {
+		if pattern.ExpandTemplate(entry, vars) == harborProject {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidConditionError reports a condition that cannot be evaluated, as opposed
+// to one that does not hold
+type invalidConditionError struct {
+	err error
+}
+
+func (e *invalidConditionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidConditionError) Unwrap() error {
+	return e.err
+}
+
+// checkConditions verifies that every claim condition matches the identity's token claims.
+// Condition values are glob patterns, e.g. "release/*" for the ref claim.
+// Conditions are checked in claim name order, so the reported failure is stable.
+// Conditions that cannot be evaluated are reported as *invalidConditionError.
+func checkConditions(conditions map[string]string, id *identity.Identity) error {
+	names := make([]string, 0, len(conditions))
+	for name := range conditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		expected := conditions[name]
+		actual, ok := id.Claim(name)
+		if !ok {
+			return &invalidConditionError{err: fmt.Errorf("unsupported condition claim '%s'", name)}
+		}
+
+		matched, err := path.Match(expected, actual)
+		if err != nil {
+			return &invalidConditionError{err: fmt.Errorf("invalid condition pattern '%s' for claim '%s': %w", expected, name, err)}
+		}
+		if !matched {
+			return fmt.Errorf("condition '%s=%s' not satisfied (got '%s')", name, expected, actual)
+		}
+	}
+	return nil
 }
 
 // contains checks if a slice contains a string
@@ -90,13 +451,3 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
-
-// ValidatePermission checks if a permission value is valid
-func ValidatePermission(permission string) error {
-	switch permission {
-	case "read", "write", "read-write":
-		return nil
-	default:
-		return fmt.Errorf("invalid permission: must be 'read', 'write', or 'read-write'")
-	}
-}
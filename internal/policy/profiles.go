@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/config"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+)
+
+// builtinProfiles are the permission profiles that are always available.
+// Both 'write' and 'read-write' require pull + push permissions
+// as Harbor requires pull access to push images (to check if layers exist).
+var builtinProfiles = map[string][]harbor.Access{
+	"read": {
+		{Resource: "repository", Action: "pull"},
+	},
+	"write": {
+		{Resource: "repository", Action: "pull"},
+		{Resource: "repository", Action: "push"},
+	},
+	"read-write": {
+		{Resource: "repository", Action: "pull"},
+		{Resource: "repository", Action: "push"},
+	},
+}
+
+// ErrUnknownPermission is returned when a permission is neither a built-in nor a configured profile
+var ErrUnknownPermission = errors.New("unknown permission")
+
+// IsBuiltinProfile checks if a permission name is one of the built-in profiles
+func IsBuiltinProfile(name string) bool {
+	_, ok := builtinProfiles[name]
+	return ok
+}
+
+// ProfileStore interface for permission profile storage backends
+type ProfileStore interface {
+	// GetPermissionProfile returns the access list of a profile, or false if it does not exist
+	GetPermissionProfile(ctx context.Context, name string) ([]harbor.Access, bool, error)
+}
+
+// Profiles resolves permission names to Harbor access actions
+type Profiles struct {
+	profiles map[string][]harbor.Access
+	store    ProfileStore
+}
+
+// NewProfiles creates a profile resolver with config-based profiles
+func NewProfiles(profiles map[string][]config.AccessRule) *Profiles {
+	converted := make(map[string][]harbor.Access, len(profiles))
+	for name, rules := range profiles {
+		access := make([]harbor.Access, 0, len(rules))
+		for _, rule := range rules {
+			access = append(access, harbor.Access{Resource: rule.Resource, Action: rule.Action})
+		}
+		converted[name] = access
+	}
+
+	return &Profiles{
+		profiles: converted,
+	}
+}
+
+// NewProfilesWithStore creates a profile resolver with database-backed storage
+func NewProfilesWithStore(store ProfileStore) *Profiles {
+	return &Profiles{
+		store: store,
+	}
+}
+
+// Resolve returns the Harbor access actions granted by a permission profile.
+// Returns ErrUnknownPermission if no profile has the name.
+func (p *Profiles) Resolve(ctx context.Context, name string) ([]harbor.Access, error) {
+	if access, ok := builtinProfiles[name]; ok {
+		return access, nil
+	}
+
+	if p.store != nil {
+		access, ok, err := p.store.GetPermissionProfile(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch permission profile: %w", err)
+		}
+		if ok {
+			return access, nil
+		}
+	} else if access, ok := p.profiles[name]; ok {
+		return access, nil
+	}
+
+	return nil, p.unknownPermissionError(name)
+}
+
+// ValidatePermission checks if a permission value is a built-in or configured profile
+func (p *Profiles) ValidatePermission(ctx context.Context, permission string) error {
+	_, err := p.Resolve(ctx, permission)
+	return err
+}
+
+// unknownPermissionError lists the valid permission names in config mode
+func (p *Profiles) unknownPermissionError(name string) error {
+	names := []string{"read", "write", "read-write"}
+	if p.store == nil {
+		configured := make([]string, 0, len(p.profiles))
+		for profile := range p.profiles {
+			configured = append(configured, profile)
+		}
+		sort.Strings(configured)
+		names = append(names, configured...)
+	}
+
+	return fmt.Errorf("%w '%s': must be one of '%s'", ErrUnknownPermission, name, strings.Join(names, "', '"))
+}
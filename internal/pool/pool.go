@@ -0,0 +1,400 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/registry"
+)
+
+// RobotScope is the robot scope recorded in the audit log for pool leases
+const RobotScope = "pool"
+
+// Entry sets the number of pool robots for a Harbor project and permission
+type Entry struct {
+	HarborProject string
+	Permission    string
+	Access        []harbor.Access
+	Size          int
+}
+
+// Lease is a pool robot handed out to a CI job until ExpiresAt
+type Lease struct {
+	RobotID         int64
+	RobotName       string
+	IdentitySource  string
+	PolicyNamespace string
+	GitLabProject   string
+	HarborProject   string
+	Permission      string
+	PipelineID      string
+	JobID           string
+	ExpiresAt       time.Time
+}
+
+// renewBefore is how long before Harbor expires an idle pool robot it is replaced
+const renewBefore = 24 * time.Hour
+
+// robot is a pool robot account and its current lease
+type robot struct {
+	id         int64
+	name       string
+	validUntil time.Time // when Harbor expires the robot
+	lease      *Lease    // nil while the robot is idle
+	busy       bool      // a secret refresh or deletion is in flight
+}
+
+// Pool hands out pre-provisioned robot accounts by refreshing their secret,
+// which saves the project lookup and robot creation of every /token request.
+// Leased robots are reclaimed by refreshing their secret again once the lease
+// expires, so the secret handed out stops working.
+//
+// Leases are only held in memory. Every broker instance therefore has pool
+// robots of its own, named after its instance ID; on startup, the secrets of
+// the instance's pool robots are refreshed.
+//
+// Pool robots expire in Harbor after the configured lifetime, so a leaked
+// secret does not stay valid forever, e.g. if the broker dies before it
+// reclaims a lease. Idle robots are replaced before they expire.
+type Pool struct {
+	harborClient *harbor.Client
+	logger       *logging.Logger
+	entries      []Entry
+	instanceID   string
+	lifetimeDays int64
+	interval     time.Duration
+
+	mu     sync.Mutex
+	robots map[string][]*robot // by poolKey
+}
+
+// NewPool creates a new robot pool for a broker instance; Fill must be called before use.
+// Robots are valid in Harbor for robotLifetime, rounded up to whole days.
+func NewPool(harborClient *harbor.Client, logger *logging.Logger, entries []Entry, instanceID string, robotLifetime, interval time.Duration) *Pool {
+	day := 24 * time.Hour
+	return &Pool{
+		harborClient: harborClient,
+		logger:       logger,
+		entries:      entries,
+		instanceID:   instanceID,
+		lifetimeDays: int64((robotLifetime + day - 1) / day),
+		interval:     interval,
+		robots:       make(map[string][]*robot),
+	}
+}
+
+// poolKey identifies the pool for a Harbor project and permission
+func poolKey(harborProject, permission string) string {
+	return harborProject + "\x00" + permission
+}
+
+// namePrefix returns the name prefix of this instance's pool robots
+func (p *Pool) namePrefix() string {
+	return harbor.PoolRobotNamePrefix + p.instanceID + "-"
+}
+
+// robotName returns the name of the pool robot with the given index
+func (p *Pool) robotName(entry Entry, index int) string {
+	return fmt.Sprintf("%s%s-%d", p.namePrefix(), strings.ToLower(entry.Permission), index)
+}
+
+// Fill brings every pool to its configured size. Pool robots of this instance
+// that already exist in Harbor are adopted with a fresh secret, as a previous
+// broker process may have handed out their old one; robots that are missing,
+// never expire or expire soon are (re)created.
+func (p *Pool) Fill(ctx context.Context) error {
+	existing, err := p.harborClient.ListRobotAccounts(ctx, p.namePrefix())
+	if err != nil {
+		return fmt.Errorf("failed to list pool robots: %w", err)
+	}
+
+	for _, entry := range p.entries {
+		key := poolKey(entry.HarborProject, entry.Permission)
+
+		p.mu.Lock()
+		have := make(map[string]bool, len(p.robots[key]))
+		for _, r := range p.robots[key] {
+			have[r.name] = true
+		}
+		p.mu.Unlock()
+
+		for i := 0; i < entry.Size; i++ {
+			name := p.robotName(entry, i)
+
+			var added *robot
+			info, ok := findRobot(existing, entry.HarborProject, name)
+			if ok && have[info.Name] {
+				continue
+			}
+			if ok && (info.ValidUntil().IsZero() || time.Until(info.ValidUntil()) < renewBefore) {
+				// Replace robots that never expire, e.g. from older versions, or expire soon
+				if err := p.harborClient.DeleteRobotAccount(ctx, info.ID); err != nil && !errors.Is(err, harbor.ErrRobotNotFound) {
+					return fmt.Errorf("failed to delete expiring pool robot %s: %w", info.Name, err)
+				}
+				ok = false
+			}
+			if ok {
+				if _, err := p.harborClient.RefreshRobotSecret(ctx, info.ID); err != nil {
+					return fmt.Errorf("failed to refresh secret of pool robot %s: %w", info.Name, err)
+				}
+				added = &robot{id: info.ID, name: info.Name, validUntil: info.ValidUntil()}
+			} else {
+				created, err := p.harborClient.CreatePoolRobotAccount(ctx, entry.HarborProject, name, entry.Access, p.lifetimeDays)
+				if err != nil {
+					return fmt.Errorf("failed to create pool robot %s in project %s: %w", name, entry.HarborProject, err)
+				}
+				added = &robot{id: created.ID, name: created.Name, validUntil: created.ValidUntil}
+			}
+
+			p.mu.Lock()
+			p.robots[key] = append(p.robots[key], added)
+			p.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// findRobot looks up a project robot by its short name in a robot list.
+// Harbor names project robots "<prefix><project>+<name>".
+func findRobot(robots []harbor.RobotInfo, harborProject, name string) (harbor.RobotInfo, bool) {
+	suffix := "$" + harborProject + "+" + name
+	for _, info := range robots {
+		if strings.HasSuffix(info.Name, suffix) {
+			return info, true
+		}
+	}
+	return harbor.RobotInfo{}, false
+}
+
+// Acquire leases an idle pool robot for the lease's Harbor project and permission
+// and returns it with a fresh secret. A job that already holds a lease for the
+// same project and permission gets that robot again with a new secret. Robots
+// that Harbor expires before the lease ends are skipped. The second return
+// value is false if there is no pool for the project and permission or all of
+// its robots are leased.
+func (p *Pool) Acquire(ctx context.Context, lease Lease) (*harbor.RobotAccount, bool, error) {
+	key := poolKey(lease.HarborProject, lease.Permission)
+
+	p.mu.Lock()
+	var picked *robot
+	for _, r := range p.robots[key] {
+		if r.busy || !r.validUntil.After(lease.ExpiresAt) {
+			continue
+		}
+		if r.lease != nil && lease.JobID != "" && r.lease.PolicyNamespace == lease.PolicyNamespace && r.lease.JobID == lease.JobID {
+			picked = r
+			break
+		}
+		if r.lease == nil && picked == nil {
+			picked = r
+		}
+	}
+	if picked == nil {
+		p.mu.Unlock()
+		return nil, false, nil
+	}
+	previous := picked.lease
+	picked.busy = true
+	lease.RobotID = picked.id
+	lease.RobotName = picked.name
+	picked.lease = &lease
+	p.mu.Unlock()
+
+	secret, err := p.harborClient.RefreshRobotSecret(ctx, picked.id)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	picked.busy = false
+	if err != nil {
+		picked.lease = previous
+		if errors.Is(err, harbor.ErrRobotNotFound) {
+			p.remove(key, picked)
+		}
+		return nil, false, fmt.Errorf("failed to refresh secret of pool robot %s: %w", picked.name, err)
+	}
+
+	return &harbor.RobotAccount{
+		ID:        picked.id,
+		Name:      picked.name,
+		Secret:    secret,
+		ExpiresAt: lease.ExpiresAt,
+	}, true, nil
+}
+
+// Run reclaims expired leases and replaces lost or expiring pool robots
+// periodically until the context is cancelled
+func (p *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	p.logger.Info(fmt.Sprintf("Robot pool started (reclaim interval %s)", p.interval))
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.logger.Info("Robot pool stopped")
+			return
+		case <-ticker.C:
+			p.ReclaimOnce(ctx)
+			p.retireExpiring(ctx)
+			if p.missing() {
+				if err := p.Fill(ctx); err != nil {
+					p.logger.Error("Failed to refill robot pool", err)
+				}
+			}
+		}
+	}
+}
+
+// ReclaimOnce returns every robot whose lease has expired to the pool
+func (p *Pool) ReclaimOnce(ctx context.Context) {
+	now := time.Now()
+	p.release(ctx, func(lease *Lease) bool {
+		return !lease.ExpiresAt.After(now)
+	}, func(lease Lease) {
+		p.logger.AuditRobotReclaimed(lease.IdentitySource, lease.PolicyNamespace, lease.GitLabProject, lease.HarborProject, lease.Permission, lease.RobotID, lease.RobotName, "lease expired", lease.PipelineID, lease.JobID, registry.DefaultName)
+	})
+}
+
+// RevokeJob ends every lease held by the given CI job
+func (p *Pool) RevokeJob(ctx context.Context, policyNamespace, jobID string) ([]Lease, error) {
+	return p.revoke(ctx, func(lease *Lease) bool {
+		return lease.PolicyNamespace == policyNamespace && lease.JobID == jobID
+	}, fmt.Sprintf("revoked by job %s", jobID))
+}
+
+// RevokePipeline ends every lease held by any job of the given CI pipeline
+func (p *Pool) RevokePipeline(ctx context.Context, policyNamespace, pipelineID string) ([]Lease, error) {
+	return p.revoke(ctx, func(lease *Lease) bool {
+		return lease.PolicyNamespace == policyNamespace && lease.PipelineID == pipelineID
+	}, fmt.Sprintf("revoked by pipeline %s", pipelineID))
+}
+
+// revoke ends all leases accepted by match and records them as revoked
+func (p *Pool) revoke(ctx context.Context, match func(*Lease) bool, reason string) ([]Lease, error) {
+	var revoked []Lease
+	err := p.release(ctx, match, func(lease Lease) {
+		p.logger.AuditRobotRevoked(lease.IdentitySource, lease.PolicyNamespace, lease.GitLabProject, lease.HarborProject, lease.Permission, lease.RobotID, lease.RobotName, reason, lease.PipelineID, lease.JobID, registry.DefaultName)
+		revoked = append(revoked, lease)
+	})
+	return revoked, err
+}
+
+// release refreshes the secret of every leased robot accepted by match, so the
+// secret handed out stops working, and makes the robot idle again. Robots whose
+// secret cannot be refreshed stay leased and are retried on the next reclaim.
+func (p *Pool) release(ctx context.Context, match func(*Lease) bool, released func(Lease)) error {
+	type candidate struct {
+		key   string
+		robot *robot
+	}
+
+	p.mu.Lock()
+	var candidates []candidate
+	for key, robots := range p.robots {
+		for _, r := range robots {
+			if r.busy || r.lease == nil || !match(r.lease) {
+				continue
+			}
+			r.busy = true
+			candidates = append(candidates, candidate{key: key, robot: r})
+		}
+	}
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, c := range candidates {
+		_, err := p.harborClient.RefreshRobotSecret(ctx, c.robot.id)
+
+		p.mu.Lock()
+		c.robot.busy = false
+		lease := *c.robot.lease
+		switch {
+		case err == nil:
+			c.robot.lease = nil
+		case errors.Is(err, harbor.ErrRobotNotFound):
+			// The robot is gone, and so is the secret; Run replaces the robot
+			p.remove(c.key, c.robot)
+		default:
+			p.mu.Unlock()
+			p.logger.Error(fmt.Sprintf("Failed to reclaim pool robot %s", c.robot.name), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.mu.Unlock()
+
+		released(lease)
+	}
+
+	return firstErr
+}
+
+// retireExpiring deletes idle robots that Harbor expires within renewBefore;
+// Run creates their replacements
+func (p *Pool) retireExpiring(ctx context.Context) {
+	type candidate struct {
+		key   string
+		robot *robot
+	}
+
+	p.mu.Lock()
+	var candidates []candidate
+	for key, robots := range p.robots {
+		for _, r := range robots {
+			if r.busy || r.lease != nil || time.Until(r.validUntil) >= renewBefore {
+				continue
+			}
+			r.busy = true
+			candidates = append(candidates, candidate{key: key, robot: r})
+		}
+	}
+	p.mu.Unlock()
+
+	for _, c := range candidates {
+		err := p.harborClient.DeleteRobotAccount(ctx, c.robot.id)
+
+		p.mu.Lock()
+		c.robot.busy = false
+		if err == nil || errors.Is(err, harbor.ErrRobotNotFound) {
+			p.remove(c.key, c.robot)
+		}
+		p.mu.Unlock()
+
+		if err != nil && !errors.Is(err, harbor.ErrRobotNotFound) {
+			p.logger.Error(fmt.Sprintf("Failed to delete expiring pool robot %s", c.robot.name), err)
+		}
+	}
+}
+
+// remove drops a robot from its pool; the caller must hold p.mu
+func (p *Pool) remove(key string, gone *robot) {
+	robots := p.robots[key]
+	for i, r := range robots {
+		if r == gone {
+			p.robots[key] = append(robots[:i], robots[i+1:]...)
+			return
+		}
+	}
+}
+
+// missing reports whether any pool has fewer robots than configured
+func (p *Pool) missing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, entry := range p.entries {
+		if len(p.robots[poolKey(entry.HarborProject, entry.Permission)]) < entry.Size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,380 @@
+package reaper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/logging"
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/registry"
+)
+
+// RobotStore interface for looking up robot accounts issued by the broker
+type RobotStore interface {
+	// ListIssuedRobots returns all issued robot accounts that have not been deleted yet
+	ListIssuedRobots(ctx context.Context) ([]TrackedRobot, error)
+	// ListLiveJobRobots returns the unexpired, undeleted robots issued to a CI job in a registry
+	ListLiveJobRobots(ctx context.Context, registry, policyNamespace, jobID string) ([]TrackedRobot, error)
+	// ListLivePipelineRobots returns the unexpired, undeleted robots issued to a CI pipeline in a registry
+	ListLivePipelineRobots(ctx context.Context, registry, policyNamespace, pipelineID string) ([]TrackedRobot, error)
+}
+
+// RobotScopePipeline marks robots shared by all jobs of a pipeline
+const RobotScopePipeline = "pipeline"
+
+// TrackedRobot represents a robot account issued by the broker.
+// Shared pipeline robots keep the job ID of the job they were created for.
+// Robot IDs are only unique per registry.
+type TrackedRobot struct {
+	Registry        string // registry.DefaultName for the harbor section
+	ID              int64
+	Name            string
+	IdentitySource  string
+	PolicyNamespace string
+	GitLabProject   string
+	HarborProject   string
+	Permission      string
+	PipelineID      string
+	JobID           string
+	RobotScope      string // "job" or RobotScopePipeline
+	ExpiresAt       time.Time
+}
+
+// Shared reports whether the robot is shared by all jobs of a pipeline
+func (r TrackedRobot) Shared() bool {
+	return r.RobotScope == RobotScopePipeline
+}
+
+// projectPermission is one Harbor project of a robot and the permission granted on it
+type projectPermission struct {
+	harborProject string
+	permission    string
+}
+
+// projects splits the comma-separated Harbor projects and permissions of a robot into pairs
+func (r TrackedRobot) projects() []projectPermission {
+	harborProjects := strings.Split(r.HarborProject, ",")
+	permissions := strings.Split(r.Permission, ",")
+
+	pairs := make([]projectPermission, len(harborProjects))
+	for i, harborProject := range harborProjects {
+		pairs[i].harborProject = harborProject
+		if i < len(permissions) {
+			pairs[i].permission = permissions[i]
+		}
+	}
+	return pairs
+}
+
+// robotKey identifies a robot across registries
+type robotKey struct {
+	registry string
+	id       int64
+}
+
+func (r TrackedRobot) key() robotKey {
+	return robotKey{registry: r.Registry, id: r.ID}
+}
+
+// robotLister is implemented by backends whose robots can be listed for the orphan sweep
+type robotLister interface {
+	ListRobotAccounts(ctx context.Context, nameFragment string) ([]harbor.RobotInfo, error)
+}
+
+// Reaper deletes robot accounts from Harbor once their intended TTL has passed,
+// or earlier when a CI job revokes them explicitly.
+//
+// Harbor only supports robot durations in whole days, so every robot the broker
+// creates would stay usable for up to 24 hours. The reaper closes that gap by
+// deleting each robot as soon as the expires_at returned to the CI job passes.
+// Credentials of other registry backends are revoked the same way.
+type Reaper struct {
+	registries  *registry.Set
+	store       RobotStore
+	logger      *logging.Logger
+	interval    time.Duration
+	orphanSweep bool
+	orphanGrace time.Duration
+
+	mu      sync.Mutex
+	tracked map[robotKey]TrackedRobot
+}
+
+// NewReaper creates a new robot reaper with in-memory tracking
+func NewReaper(registries *registry.Set, logger *logging.Logger, interval time.Duration, orphanSweep bool, orphanGrace time.Duration) *Reaper {
+	return &Reaper{
+		registries:  registries,
+		logger:      logger,
+		interval:    interval,
+		orphanSweep: orphanSweep,
+		orphanGrace: orphanGrace,
+		tracked:     make(map[robotKey]TrackedRobot),
+	}
+}
+
+// NewReaperWithStore creates a new robot reaper that also reads issued robots
+// from a persistent store, so robots survive broker restarts
+func NewReaperWithStore(registries *registry.Set, store RobotStore, logger *logging.Logger, interval time.Duration, orphanSweep bool, orphanGrace time.Duration) *Reaper {
+	r := NewReaper(registries, logger, interval, orphanSweep, orphanGrace)
+	r.store = store
+	return r
+}
+
+// Track registers an issued robot account for deletion after it expires.
+// Tracking a known robot again replaces it, e.g. to extend its expiry.
+func (r *Reaper) Track(robot TrackedRobot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tracked[robot.key()] = robot
+}
+
+// Run reaps robot accounts periodically until the context is cancelled
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.logger.Info(fmt.Sprintf("Robot reaper started (interval %s)", r.interval))
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.logger.Info("Robot reaper stopped")
+			return
+		case <-ticker.C:
+			if err := r.ReapOnce(ctx); err != nil {
+				r.logger.Error("Robot reaper run failed", err)
+			}
+		}
+	}
+}
+
+// ReapOnce deletes all expired robots and, if enabled, orphaned ci-temp robots
+func (r *Reaper) ReapOnce(ctx context.Context) error {
+	known, err := r.knownRobots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list issued robots: %w", err)
+	}
+
+	now := time.Now()
+	for _, robot := range known {
+		if robot.ExpiresAt.After(now) {
+			continue
+		}
+		r.deleteRobot(ctx, robot, "expired")
+	}
+
+	if !r.orphanSweep {
+		return nil
+	}
+
+	if err := r.sweepOrphans(ctx, known, now); err != nil {
+		return fmt.Errorf("failed to sweep orphaned robots: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeJob deletes every robot issued to the given CI job.
+// Job IDs are only unique per GitLab instance, so the policy namespace must match too.
+// Shared pipeline robots are kept, as other jobs of the pipeline may still use them.
+func (r *Reaper) RevokeJob(ctx context.Context, policyNamespace, jobID string) ([]TrackedRobot, error) {
+	return r.revoke(ctx, func(robot TrackedRobot) bool {
+		return robot.PolicyNamespace == policyNamespace && robot.JobID == jobID && !robot.Shared()
+	}, fmt.Sprintf("revoked by job %s", jobID))
+}
+
+// RevokePipeline deletes every robot issued to any job of the given CI pipeline
+func (r *Reaper) RevokePipeline(ctx context.Context, policyNamespace, pipelineID string) ([]TrackedRobot, error) {
+	return r.revoke(ctx, func(robot TrackedRobot) bool {
+		return robot.PolicyNamespace == policyNamespace && robot.PipelineID == pipelineID
+	}, fmt.Sprintf("revoked by pipeline %s", pipelineID))
+}
+
+// ActiveRobot returns the unexpired robot issued to a CI job in a registry for the
+// given Harbor projects and permissions (comma-separated, in request order), if there is one
+func (r *Reaper) ActiveRobot(ctx context.Context, registryName, policyNamespace, jobID, harborProject, permission string) (TrackedRobot, bool, error) {
+	var stored []TrackedRobot
+	if r.store != nil {
+		var err error
+		stored, err = r.store.ListLiveJobRobots(ctx, registryName, policyNamespace, jobID)
+		if err != nil {
+			return TrackedRobot{}, false, fmt.Errorf("failed to list robots of job: %w", err)
+		}
+	}
+	return r.activeRobot(stored, func(robot TrackedRobot) bool {
+		return robot.Registry == registryName && robot.PolicyNamespace == policyNamespace && robot.JobID == jobID && !robot.Shared() &&
+			robot.HarborProject == harborProject && robot.Permission == permission
+	})
+}
+
+// ActivePipelineRobot returns the unexpired shared robot of a CI pipeline in a registry
+// for the given Harbor projects and permissions, if there is one
+func (r *Reaper) ActivePipelineRobot(ctx context.Context, registryName, policyNamespace, pipelineID, harborProject, permission string) (TrackedRobot, bool, error) {
+	var stored []TrackedRobot
+	if r.store != nil {
+		var err error
+		stored, err = r.store.ListLivePipelineRobots(ctx, registryName, policyNamespace, pipelineID)
+		if err != nil {
+			return TrackedRobot{}, false, fmt.Errorf("failed to list robots of pipeline: %w", err)
+		}
+	}
+	return r.activeRobot(stored, func(robot TrackedRobot) bool {
+		return robot.Registry == registryName && robot.PolicyNamespace == policyNamespace && robot.PipelineID == pipelineID && robot.Shared() &&
+			robot.HarborProject == harborProject && robot.Permission == permission
+	})
+}
+
+// activeRobot returns the unexpired robot accepted by match that lives longest,
+// among the given stored robots and the robots tracked in memory
+func (r *Reaper) activeRobot(stored []TrackedRobot, match func(TrackedRobot) bool) (TrackedRobot, bool, error) {
+	known := make(map[robotKey]TrackedRobot, len(stored))
+	for _, robot := range stored {
+		known[robot.key()] = robot
+	}
+	r.mu.Lock()
+	for key, robot := range r.tracked {
+		known[key] = robot
+	}
+	r.mu.Unlock()
+
+	now := time.Now()
+	var active TrackedRobot
+	found := false
+	for _, robot := range known {
+		if !match(robot) || !robot.ExpiresAt.After(now) {
+			continue
+		}
+		if !found || robot.ExpiresAt.After(active.ExpiresAt) {
+			active = robot
+			found = true
+		}
+	}
+
+	return active, found, nil
+}
+
+// revoke deletes all known robots accepted by match and records them as revoked
+func (r *Reaper) revoke(ctx context.Context, match func(TrackedRobot) bool, reason string) ([]TrackedRobot, error) {
+	known, err := r.knownRobots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list issued robots: %w", err)
+	}
+
+	var revoked []TrackedRobot
+	var firstErr error
+	for _, robot := range known {
+		if !match(robot) {
+			continue
+		}
+		if err := r.removeRobot(ctx, robot); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, project := range robot.projects() {
+			r.logger.AuditRobotRevoked(robot.IdentitySource, robot.PolicyNamespace, robot.GitLabProject, project.harborProject, project.permission, robot.ID, robot.Name, reason, robot.PipelineID, robot.JobID, robot.Registry)
+		}
+		revoked = append(revoked, robot)
+	}
+
+	return revoked, firstErr
+}
+
+// knownRobots merges in-memory tracked robots with robots from the store
+func (r *Reaper) knownRobots(ctx context.Context) (map[robotKey]TrackedRobot, error) {
+	known := make(map[robotKey]TrackedRobot)
+
+	if r.store != nil {
+		stored, err := r.store.ListIssuedRobots(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, robot := range stored {
+			known[robot.key()] = robot
+		}
+	}
+
+	r.mu.Lock()
+	for key, robot := range r.tracked {
+		known[key] = robot
+	}
+	r.mu.Unlock()
+
+	return known, nil
+}
+
+// sweepOrphans deletes ci-temp robots in Harbor that the broker does not know about.
+// Backends that cannot list their credentials are skipped.
+func (r *Reaper) sweepOrphans(ctx context.Context, known map[robotKey]TrackedRobot, now time.Time) error {
+	var firstErr error
+	for _, name := range r.registries.Names() {
+		backend, _ := r.registries.Get(name)
+		lister, ok := backend.(robotLister)
+		if !ok {
+			continue
+		}
+
+		robots, err := lister.ListRobotAccounts(ctx, harbor.RobotNamePrefix)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", registry.DisplayName(name), err)
+			}
+			continue
+		}
+
+		for _, robot := range robots {
+			if !strings.Contains(robot.Name, harbor.RobotNamePrefix) {
+				continue
+			}
+			if _, ok := known[robotKey{registry: name, id: robot.ID}]; ok {
+				continue
+			}
+			// Give in-flight issuance a chance to be tracked before treating the robot as orphaned
+			if now.Sub(robot.CreationTime) < r.orphanGrace {
+				continue
+			}
+
+			r.deleteRobot(ctx, TrackedRobot{Registry: name, ID: robot.ID, Name: robot.Name}, "orphaned")
+		}
+	}
+
+	return firstErr
+}
+
+// deleteRobot deletes a robot from Harbor and records the deletion in the audit log
+func (r *Reaper) deleteRobot(ctx context.Context, robot TrackedRobot, reason string) {
+	if err := r.removeRobot(ctx, robot); err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to delete robot account %d", robot.ID), err)
+		return
+	}
+
+	// One audit row per project, like on issuance
+	for _, project := range robot.projects() {
+		r.logger.AuditRobotDeleted(robot.IdentitySource, robot.PolicyNamespace, robot.GitLabProject, project.harborProject, project.permission, robot.ID, robot.Name, reason, robot.PipelineID, robot.JobID, robot.Registry)
+	}
+}
+
+// removeRobot deletes a robot from its registry and stops tracking it.
+// Robots that are already gone from the registry are treated as removed.
+func (r *Reaper) removeRobot(ctx context.Context, robot TrackedRobot) error {
+	backend, ok := r.registries.Get(robot.Registry)
+	if !ok {
+		return fmt.Errorf("registry '%s' is not configured", registry.DisplayName(robot.Registry))
+	}
+	err := backend.RevokeCredential(ctx, robot.ID)
+	if err != nil && !errors.Is(err, harbor.ErrRobotNotFound) {
+		return err
+	}
+
+	r.mu.Lock()
+	delete(r.tracked, robot.key())
+	r.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/lukaskohlmaier/gitlab-harbor-token-broker/internal/harbor"
+)
+
+// DefaultName is the name of the Harbor instance configured in the harbor section.
+// Policies without a registry use it.
+const DefaultName = ""
+
+// Backend issues short-lived credentials for a container registry.
+//
+// Credentials are described with Harbor's types: permission profiles are lists
+// of Harbor resource/action pairs, and other backends map them onto their own
+// permission model.
+type Backend interface {
+	// IssueCredential creates a credential with the access of every grant that
+	// the broker hands out for ttlMinutes
+	IssueCredential(ctx context.Context, name string, grants []harbor.ProjectGrant, ttlMinutes int) (*harbor.RobotAccount, error)
+	// RevokeCredential invalidates an issued credential.
+	// Returns harbor.ErrRobotNotFound if the backend does not know the credential.
+	RevokeCredential(ctx context.Context, id int64) error
+	// Health reports whether the registry can be reached
+	Health(ctx context.Context) error
+	// Hostname returns the registry host that issued credentials are valid for
+	Hostname() string
+}
+
+// SecretRefresher is implemented by backends that can replace the secret of an
+// issued credential, so a retried request does not need a second credential
+type SecretRefresher interface {
+	// RefreshRobotSecret returns a new secret for a credential; the old one stops working.
+	// Returns harbor.ErrRobotNotFound if the backend does not know the credential.
+	RefreshRobotSecret(ctx context.Context, id int64) (string, error)
+}
+
+// Set holds the configured registry backends by name
+type Set struct {
+	backends map[string]Backend
+	names    []string
+}
+
+// NewSet creates an empty backend set
+func NewSet() *Set {
+	return &Set{
+		backends: make(map[string]Backend),
+	}
+}
+
+// Add registers a backend under a name; the default Harbor instance uses DefaultName
+func (s *Set) Add(name string, backend Backend) {
+	if _, ok := s.backends[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.backends[name] = backend
+}
+
+// Get returns the backend with the given name
+func (s *Set) Get(name string) (Backend, bool) {
+	backend, ok := s.backends[name]
+	return backend, ok
+}
+
+// Names returns the names of all backends in the order they were added
+func (s *Set) Names() []string {
+	return append([]string(nil), s.names...)
+}
+
+// DisplayName returns a registry name for logs and API responses
+func DisplayName(name string) string {
+	if name == DefaultName {
+		return "harbor"
+	}
+	return name
+}
@@ -0,0 +1,114 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often expired token IDs are removed
+const pruneInterval = 1 * time.Minute
+
+// Store interface for persistent used-token storage, shared by broker replicas
+type Store interface {
+	// MarkTokenUsed records a token ID until it expires and reports whether it was already recorded
+	MarkTokenUsed(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error)
+	// ForgetToken removes a token ID, e.g. after issuance failed
+	ForgetToken(ctx context.Context, tokenID string) error
+	// DeleteExpiredTokens removes token IDs that expired before now
+	DeleteExpiredTokens(ctx context.Context, now time.Time) error
+}
+
+// Guard detects CI tokens that are presented more than once.
+// Token IDs are kept until the token expires, after which the validator rejects it anyway.
+type Guard struct {
+	store Store
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewGuard creates a replay guard with in-memory tracking
+func NewGuard() *Guard {
+	return &Guard{
+		seen: make(map[string]time.Time),
+	}
+}
+
+// NewGuardWithStore creates a replay guard with persistent storage
+func NewGuardWithStore(store Store) *Guard {
+	g := NewGuard()
+	g.store = store
+	return g
+}
+
+// Check records a token ID and reports whether it was used before.
+// Tokens without an ID cannot be tracked and are never reported as replayed.
+func (g *Guard) Check(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	if tokenID == "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	if err := g.prune(ctx, now); err != nil {
+		return false, err
+	}
+
+	if g.store != nil {
+		replayed, err := g.store.MarkTokenUsed(ctx, tokenID, expiresAt)
+		if err != nil {
+			return false, fmt.Errorf("failed to record token use: %w", err)
+		}
+		return replayed, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if until, ok := g.seen[tokenID]; ok && until.After(now) {
+		return true, nil
+	}
+	g.seen[tokenID] = expiresAt
+	return false, nil
+}
+
+// Forget removes a token ID so the token can be used again
+func (g *Guard) Forget(ctx context.Context, tokenID string) error {
+	if tokenID == "" {
+		return nil
+	}
+
+	if g.store != nil {
+		return g.store.ForgetToken(ctx, tokenID)
+	}
+
+	g.mu.Lock()
+	delete(g.seen, tokenID)
+	g.mu.Unlock()
+	return nil
+}
+
+// prune removes expired token IDs at most once per pruneInterval
+func (g *Guard) prune(ctx context.Context, now time.Time) error {
+	g.mu.Lock()
+	if now.Sub(g.lastPrune) < pruneInterval {
+		g.mu.Unlock()
+		return nil
+	}
+	g.lastPrune = now
+	for tokenID, until := range g.seen {
+		if !until.After(now) {
+			delete(g.seen, tokenID)
+		}
+	}
+	g.mu.Unlock()
+
+	if g.store != nil {
+		if err := g.store.DeleteExpiredTokens(ctx, now); err != nil {
+			return fmt.Errorf("failed to delete expired token IDs: %w", err)
+		}
+	}
+	return nil
+}
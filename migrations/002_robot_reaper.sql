@@ -0,0 +1,2 @@
+-- Index access_logs by robot for the reaper's issued/deleted lookups
+CREATE INDEX IF NOT EXISTS idx_access_logs_robot_id ON access_logs (robot_id);
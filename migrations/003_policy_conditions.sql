@@ -0,0 +1,3 @@
+-- Claim conditions that must hold before a policy rule grants access,
+-- e.g. {"ref_protected": "true", "ref_type": "branch"}
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS conditions JSONB NOT NULL DEFAULT '{}';
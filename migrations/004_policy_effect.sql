@@ -0,0 +1,2 @@
+-- Explicit deny rules: 'deny' rules override any 'allow' rule
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS effect VARCHAR(10) NOT NULL DEFAULT 'allow';
@@ -0,0 +1,4 @@
+-- Allow several policy rules per GitLab project, e.g. read on one Harbor
+-- project and write on another. Every existing row stays a valid rule of its
+-- own; only the one-row-per-project constraint is dropped.
+ALTER TABLE policy_rules DROP CONSTRAINT IF EXISTS policy_rules_gitlab_project_key;
@@ -0,0 +1,6 @@
+-- Per-rule credential lifetime limits (0 = not set)
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS max_ttl_minutes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS default_ttl_minutes INTEGER NOT NULL DEFAULT 0;
+
+-- Effective TTL granted for each issued credential
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS ttl_minutes INTEGER;
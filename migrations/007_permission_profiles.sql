@@ -0,0 +1,13 @@
+-- Named permission profiles mapping to arbitrary Harbor resource/action lists,
+-- e.g. {"name": "sign", "access": [{"resource": "repository", "action": "push"}, ...]}
+CREATE TABLE IF NOT EXISTS permission_profiles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    access JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Profile names can be longer than the built-in read/write/read-write
+ALTER TABLE access_logs ALTER COLUMN permission TYPE VARCHAR(100);
@@ -0,0 +1,8 @@
+-- Scope policies and access logs to the identity source (GitLab instance)
+-- that issued the token, so equal project paths on different instances do
+-- not collide. The empty namespace is used by the single gitlab section.
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS policy_namespace VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS policy_namespace VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_policy_rules_namespace_project ON policy_rules (policy_namespace, gitlab_project);
+CREATE INDEX IF NOT EXISTS idx_access_logs_policy_namespace ON access_logs (policy_namespace);
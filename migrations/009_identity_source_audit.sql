@@ -0,0 +1,5 @@
+-- Record which identity source (GitLab instance, GitHub Actions or Kubernetes
+-- cluster) a workload authenticated with
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS identity_source VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_access_logs_identity_source ON access_logs (identity_source);
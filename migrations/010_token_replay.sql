@@ -0,0 +1,12 @@
+-- CI token IDs (jti, or job ID and issue time) seen by the broker, kept until
+-- the token expires so replayed tokens can be detected across replicas
+CREATE TABLE IF NOT EXISTS used_tokens (
+    token_id VARCHAR(512) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_used_tokens_expires_at ON used_tokens (expires_at);
+
+-- Per-rule handling of replayed tokens: '' or 'reject', or 'deduplicate'
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS on_replay VARCHAR(20) NOT NULL DEFAULT '';
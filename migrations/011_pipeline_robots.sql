@@ -0,0 +1,5 @@
+-- Per-rule robot sharing: '' or 'job' for one robot per job, 'pipeline' for one per pipeline
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS robot_scope VARCHAR(20) NOT NULL DEFAULT '';
+
+-- Scope of each issued robot, so shared pipeline robots survive job revocations
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS robot_scope VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- Registry backend of each rule: '' for the Harbor instance of the harbor section,
+-- otherwise the name of a configured registry
+ALTER TABLE policy_rules ADD COLUMN IF NOT EXISTS registry VARCHAR(255) NOT NULL DEFAULT '';
+
+-- Registry of each issued credential, since credential IDs are only unique per registry
+ALTER TABLE access_logs ADD COLUMN IF NOT EXISTS registry VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+-- Look up the live robots of a job or pipeline on every /token request without
+-- scanning the whole access log
+CREATE INDEX IF NOT EXISTS idx_access_logs_issued_job ON access_logs (registry, policy_namespace, job_id)
+    WHERE status = 'success';
+CREATE INDEX IF NOT EXISTS idx_access_logs_issued_pipeline ON access_logs (registry, policy_namespace, pipeline_id)
+    WHERE status = 'success';
+
+-- Deletion and revocation entries, for the check whether an issued robot is gone
+CREATE INDEX IF NOT EXISTS idx_access_logs_removed_robots ON access_logs (robot_id, registry)
+    WHERE status IN ('deleted', 'revoked');
@@ -3,27 +3,74 @@ const API_BASE_URL = import.meta.env.VITE_API_URL || 'http://localhost:8080';
 export interface AccessLog {
   id: number;
   timestamp: string;
+  identity_source?: string;
+  policy_namespace?: string;
   gitlab_project: string;
   harbor_project: string;
   permission: string;
   robot_id?: number;
   robot_name?: string;
   expires_at?: string;
+  ttl_minutes?: number;
   pipeline_id?: string;
   job_id?: string;
+  robot_scope?: string;
+  registry?: string;
   status: string;
   error_message?: string;
 }
 
 export interface PolicyRule {
   id: number;
+  effect?: 'allow' | 'deny';
+  policy_namespace?: string;
   gitlab_project: string;
   harbor_projects: string[];
   allowed_permissions: string[];
+  conditions?: Record<string, string>;
+  max_ttl_minutes?: number;
+  default_ttl_minutes?: number;
+  on_replay?: '' | 'reject' | 'deduplicate';
+  robot_scope?: '' | 'job' | 'pipeline';
+  registry?: string;
   created_at: string;
   updated_at: string;
 }
 
+export interface PermissionProfile {
+  id: number;
+  name: string;
+  description: string;
+  access: { resource: string; action: string }[];
+  created_at: string;
+  updated_at: string;
+}
+
+export interface EvaluatedRule {
+  name: string;
+  effect?: 'allow' | 'deny';
+  policy_namespace?: string;
+  gitlab_project: string;
+  harbor_projects: string[];
+  allowed_permissions: string[];
+  conditions?: Record<string, string>;
+}
+
+export interface PolicyDecision {
+  allowed: boolean;
+  rule?: EvaluatedRule;
+  near_miss?: EvaluatedRule;
+  reason: string;
+}
+
+export interface EvaluateRequest {
+  token?: string;
+  claims?: Record<string, string | number>;
+  policy_namespace?: string;
+  harbor_project: string;
+  permission: string;
+}
+
 export interface AccessLogsResponse {
   logs: AccessLog[];
   total: number;
@@ -35,6 +82,8 @@ export const api = {
   async getAccessLogs(params: {
     page?: number;
     limit?: number;
+    identity_source?: string;
+    policy_namespace?: string;
     gitlab_project?: string;
     harbor_project?: string;
     status?: string;
@@ -42,6 +91,8 @@ export const api = {
     const queryParams = new URLSearchParams();
     if (params.page) queryParams.set('page', params.page.toString());
     if (params.limit) queryParams.set('limit', params.limit.toString());
+    if (params.identity_source) queryParams.set('identity_source', params.identity_source);
+    if (params.policy_namespace) queryParams.set('policy_namespace', params.policy_namespace);
     if (params.gitlab_project) queryParams.set('gitlab_project', params.gitlab_project);
     if (params.harbor_project) queryParams.set('harbor_project', params.harbor_project);
     if (params.status) queryParams.set('status', params.status);
@@ -89,6 +140,28 @@ export const api = {
     return response.json();
   },
 
+  async getPermissionProfiles(): Promise<PermissionProfile[]> {
+    const response = await fetch(`${API_BASE_URL}/api/permission-profiles`);
+    if (!response.ok) {
+      throw new Error('Failed to fetch permission profiles');
+    }
+    return response.json();
+  },
+
+  async evaluatePolicy(request: EvaluateRequest): Promise<PolicyDecision> {
+    const response = await fetch(`${API_BASE_URL}/api/policies/evaluate`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify(request),
+    });
+    if (!response.ok) {
+      throw new Error('Failed to evaluate policy');
+    }
+    return response.json();
+  },
+
   async deletePolicy(id: number): Promise<void> {
     const response = await fetch(`${API_BASE_URL}/api/policies/${id}`, {
       method: 'DELETE',